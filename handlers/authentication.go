@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
@@ -11,44 +16,155 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 	"masterboxer.com/project-micro-journal/models"
+	"masterboxer.com/project-micro-journal/services"
 )
 
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name,omitempty"`
 }
 
-var accessSecretKey = []byte("access-secret-key")
-var refreshSecretKey = []byte("refresh-secret-key")
+const (
+	tokenIssuer   = "project-micro-journal"
+	tokenAudience = "project-micro-journal-app"
 
-func createAccessToken(email string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": email,
-		"exp":   time.Now().Add(15 * time.Minute).Unix(),
-	})
-	return token.SignedString(accessSecretKey)
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// TokenClaims are the claims carried by every token we sign. The subject is
+// the user ID; TokenType keeps the different kinds from being swapped.
+// SessionID is the refresh token family the token was issued under, Role is
+// the user's role when an access token was issued, and Email is the address an
+// email verification token confirms.
+type TokenClaims struct {
+	TokenType string `json:"typ"`
+	SessionID string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Email     string `json:"email,omitempty"`
+	jwt.RegisteredClaims
 }
 
-func createRefreshToken(email string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": email,
-		"exp":   time.Now().Add(7 * 24 * time.Hour).Unix(),
-	})
-	return token.SignedString(refreshSecretKey)
+func newTokenClaims(userID int, sessionID, tokenType string, ttl time.Duration) (TokenClaims, error) {
+	jti, err := randomTokenID()
+	if err != nil {
+		return TokenClaims{}, err
+	}
+
+	now := time.Now()
+	return TokenClaims{
+		TokenType: tokenType,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(userID),
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{tokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			ID:        jti,
+		},
+	}, nil
+}
+
+func randomTokenID() (string, error) {
+	return randomToken(16)
+}
+
+// randomToken returns size random bytes, hex encoded.
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken is how single-use secrets we hand out are stored at rest.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSessionID returns a random UUID identifying a login and every refresh
+// token rotated from it.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func createAccessToken(userID int, sessionID, role string) (string, error) {
+	claims, err := newTokenClaims(userID, sessionID, accessTokenType, accessTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	claims.Role = role
+	return services.AccessKeys().Sign(claims)
+}
+
+func createRefreshToken(userID int, sessionID string) (string, error) {
+	claims, err := newTokenClaims(userID, sessionID, refreshTokenType, refreshTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	return services.RefreshKeys().Sign(claims)
+}
+
+// parseToken verifies the signature and every claim we issue, returning the
+// claims and the user ID from the subject.
+func parseToken(tokenString string, keys *services.KeySet, tokenType string) (*TokenClaims, int, error) {
+	claims := &TokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc,
+		jwt.WithValidMethods(keys.Methods()))
+	if err != nil || !token.Valid {
+		return nil, 0, fmt.Errorf("invalid token")
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, 0, fmt.Errorf("unexpected token type: %q", claims.TokenType)
+	}
+	if !claims.VerifyIssuer(tokenIssuer, true) || !claims.VerifyAudience(tokenAudience, true) {
+		return nil, 0, fmt.Errorf("invalid issuer or audience")
+	}
+	if claims.IssuedAt == nil || claims.ExpiresAt == nil || claims.ID == "" {
+		return nil, 0, fmt.Errorf("missing required claims")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return nil, 0, fmt.Errorf("invalid subject")
+	}
+
+	return claims, userID, nil
+}
+
+func parseAccessToken(tokenString string) (*TokenClaims, int, error) {
+	return parseToken(tokenString, services.AccessKeys(), accessTokenType)
+}
+
+func parseRefreshToken(tokenString string) (int, error) {
+	_, userID, err := parseToken(tokenString, services.RefreshKeys(), refreshTokenType)
+	return userID, err
 }
 
 func VerifyTokenHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		tokenString, ok := bearerToken(r)
+		if !ok {
 			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
 			return
 		}
 
-		var tokenString string
-		fmt.Sscanf(authHeader, "Bearer %s", &tokenString)
-
-		if err := verifyAccessToken(tokenString); err != nil {
+		if _, _, err := parseAccessToken(tokenString); err != nil {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
@@ -58,18 +174,13 @@ func VerifyTokenHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func verifyAccessToken(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return accessSecretKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		return fmt.Errorf("invalid token")
+// JWKSHandler publishes the public access token keys so other services can
+// verify tokens without sharing a secret.
+func JWKSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(services.AccessKeys().JWKS())
 	}
-	return nil
 }
 
 func LoginHandler(db *sql.DB) http.HandlerFunc {
@@ -80,51 +191,120 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var user models.User
-		err := db.QueryRow(`SELECT id, username, display_name, email, password 
-			FROM users WHERE email = $1`, loginReq.Email).
-			Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password)
+		guard := services.GetLoginGuard()
+		ip := clientIP(r)
+
+		wait, err := guard.RetryAfter(loginReq.Email, ip)
 		if err != nil {
-			http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-			return
+			log.Println("LoginHandler attempt lookup error:", err)
 		}
-
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password)); err != nil {
-			http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		if wait > 0 {
+			tooManyAttempts(w, wait)
 			return
 		}
 
-		accessToken, err := createAccessToken(user.Email)
+		var user models.User
+		var totpEnabled bool
+		err = db.QueryRow(`SELECT id, username, display_name, email, password, role, totp_enabled
+			FROM users WHERE email = $1`, loginReq.Email).
+			Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Password,
+				&user.Role, &totpEnabled)
+		if err == nil {
+			err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password))
+		}
 		if err != nil {
-			http.Error(w, "Could not create access token", http.StatusInternalServerError)
+			wait, recordErr := guard.RecordFailure(loginReq.Email, ip)
+			if recordErr != nil {
+				log.Println("LoginHandler attempt record error:", recordErr)
+			}
+			if wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
+			http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 			return
 		}
 
-		refreshToken, err := createRefreshToken(user.Email)
-		if err != nil {
-			http.Error(w, "Could not create refresh token", http.StatusInternalServerError)
-			return
+		// With 2FA on the password is only half a login, so the counter is
+		// left for VerifyTwoFactorLogin to reset. Otherwise logging in again
+		// would clear the failed codes and let them be guessed indefinitely.
+		if !totpEnabled {
+			if err := guard.RecordSuccess(loginReq.Email); err != nil {
+				log.Println("LoginHandler attempt reset error:", err)
+			}
 		}
 
-		expiresAt := time.Now().Add(7 * 24 * time.Hour)
+		completeLogin(w, r, db, user, totpEnabled, loginReq.DeviceName)
+	}
+}
 
-		_, err = db.Exec(`
-			INSERT INTO refresh_tokens (user_id, token, expires_at)
-			VALUES ($1, $2, $3)
-		`, user.ID, refreshToken, expiresAt)
+// completeLogin finishes a sign-in whose first factor has been checked,
+// asking for a second factor first when the account has one enabled.
+func completeLogin(w http.ResponseWriter, r *http.Request, db *sql.DB, user models.User, totpEnabled bool, deviceName string) {
+	if totpEnabled {
+		challengeToken, err := createTwoFactorChallengeToken(user.ID)
 		if err != nil {
-			http.Error(w, "Could not save refresh token: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Could not create two-factor challenge", http.StatusInternalServerError)
 			return
 		}
 
 		json.NewEncoder(w).Encode(map[string]string{
-			"access_token":  accessToken,
-			"refresh_token": refreshToken,
-			"user_id":       strconv.Itoa(user.ID),
-			"username":      user.Username,
-			"display_name":  user.DisplayName,
+			"two_factor_required": "true",
+			"challenge_token":     challengeToken,
 		})
+		return
 	}
+
+	writeLoginResponse(w, r, db, user, deviceName)
+}
+
+// writeLoginResponse starts a new session for user and writes the token pair.
+func writeLoginResponse(w http.ResponseWriter, r *http.Request, db *sql.DB, user models.User, deviceName string) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, err := createAccessToken(user.ID, sessionID, user.Role)
+	if err != nil {
+		http.Error(w, "Could not create access token", http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, err := createRefreshToken(user.ID, sessionID)
+	if err != nil {
+		http.Error(w, "Could not create refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(refreshTokenTTL)
+
+	_, err = db.Exec(`
+		INSERT INTO refresh_tokens (user_id, token, expires_at, family_id,
+			device_name, user_agent, ip_address, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+	`, user.ID, refreshToken, expiresAt, sessionID,
+		deviceName, r.UserAgent(), clientIP(r))
+	if err != nil {
+		http.Error(w, "Could not save refresh token", http.StatusInternalServerError)
+		log.Println("writeLoginResponse insert error:", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"user_id":       strconv.Itoa(user.ID),
+		"username":      user.Username,
+		"display_name":  user.DisplayName,
+		"role":          user.Role,
+	})
+}
+
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many login attempts, please try again later", http.StatusTooManyRequests)
 }
 
 func RefreshTokenHandler(db *sql.DB) http.HandlerFunc {
@@ -137,40 +317,164 @@ func RefreshTokenHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(req.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-			return refreshSecretKey, nil
-		})
-		if err != nil || !token.Valid {
+		userID, err := parseRefreshToken(req.RefreshToken)
+		if err != nil {
 			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
 			return
 		}
 
-		claims, _ := token.Claims.(jwt.MapClaims)
-		email, ok := claims["email"].(string)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("RefreshTokenHandler begin error:", err)
 			return
 		}
-
-		var count int
-		err = db.QueryRow("SELECT COUNT(*) FROM refresh_tokens WHERE token = $1", req.RefreshToken).Scan(&count)
-		if err != nil || count == 0 {
+		defer tx.Rollback()
+
+		var tokenID int
+		var familyID string
+		var revoked bool
+		var revokedReason sql.NullString
+		var expiresAt time.Time
+		var deviceName sql.NullString
+		var role string
+		err = tx.QueryRow(`
+			SELECT rt.id, rt.family_id, rt.revoked, rt.revoked_reason, rt.expires_at, rt.device_name, u.role
+			FROM refresh_tokens rt
+			JOIN users u ON u.id = rt.user_id
+			WHERE rt.token = $1 AND rt.user_id = $2
+			FOR UPDATE OF rt`,
+			req.RefreshToken, userID).Scan(&tokenID, &familyID, &revoked, &revokedReason, &expiresAt, &deviceName, &role)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println("RefreshTokenHandler lookup error:", err)
+			}
 			http.Error(w, "Refresh token not recognized", http.StatusUnauthorized)
 			return
 		}
 
-		accessToken, err := createAccessToken(email)
+		if revoked && revokedReason.String != revokedRotated {
+			// The session was signed out (or already killed for reuse); the
+			// device just has not heard yet.
+			http.Error(w, "Refresh token has been revoked", http.StatusUnauthorized)
+			return
+		}
+		if revoked {
+			// A rotated-out token came back, so someone else holds a copy of it.
+			// Kill the whole login it descends from.
+			_, err = tx.Exec(`
+				UPDATE refresh_tokens
+				SET revoked = TRUE, revoked_at = COALESCE(revoked_at, NOW()),
+				    revoked_reason = COALESCE(revoked_reason, $2)
+				WHERE family_id = $1`, familyID, revokedReuse)
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				log.Println("RefreshTokenHandler family revoke error:", err)
+			}
+			forgetSessions(userID, familyID)
+			log.Printf("Refresh token reuse detected for user %d, revoked family %s", userID, familyID)
+			http.Error(w, "Refresh token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		if time.Now().After(expiresAt) {
+			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		accessToken, err := createAccessToken(userID, familyID, role)
 		if err != nil {
 			http.Error(w, "Failed to create access token", http.StatusInternalServerError)
 			return
 		}
 
+		refreshToken, err := createRefreshToken(userID, familyID)
+		if err != nil {
+			http.Error(w, "Failed to create refresh token", http.StatusInternalServerError)
+			return
+		}
+
+		var newTokenID int
+		err = tx.QueryRow(`
+			INSERT INTO refresh_tokens (user_id, token, expires_at, family_id,
+				device_name, user_agent, ip_address, last_used_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+			RETURNING id`,
+			userID, refreshToken, time.Now().Add(refreshTokenTTL), familyID,
+			deviceName, r.UserAgent(), clientIP(r)).Scan(&newTokenID)
+		if err != nil {
+			http.Error(w, "Could not save refresh token", http.StatusInternalServerError)
+			log.Println("RefreshTokenHandler insert error:", err)
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE refresh_tokens
+			SET revoked = TRUE, revoked_at = NOW(), revoked_reason = $3, replaced_by = $1
+			WHERE id = $2`, newTokenID, tokenID, revokedRotated)
+		if err != nil {
+			http.Error(w, "Could not rotate refresh token", http.StatusInternalServerError)
+			log.Println("RefreshTokenHandler revoke error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Could not rotate refresh token", http.StatusInternalServerError)
+			log.Println("RefreshTokenHandler commit error:", err)
+			return
+		}
+
 		json.NewEncoder(w).Encode(map[string]string{
-			"access_token": accessToken,
+			"access_token":  accessToken,
+			"refresh_token": refreshToken,
 		})
 	}
 }
 
+// CleanupRefreshTokens deletes expired tokens and tokens whose whole family has
+// been revoked. Revoked tokens in a live family are kept until they expire so
+// that reuse can still be detected.
+func CleanupRefreshTokens(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM refresh_tokens
+		WHERE expires_at < NOW()
+		   OR family_id IN (
+		       SELECT family_id
+		       FROM refresh_tokens
+		       GROUP BY family_id
+		       HAVING BOOL_AND(revoked)
+		   )`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartRefreshTokenCleanup runs CleanupRefreshTokens every interval in the background.
+func StartRefreshTokenCleanup(db *sql.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := cleanupUsedTwoFactorChallenges(db); err != nil {
+				log.Printf("Error cleaning up used two-factor challenges: %v", err)
+			}
+
+			deleted, err := CleanupRefreshTokens(db)
+			if err != nil {
+				log.Printf("Error cleaning up refresh tokens: %v", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Cleaned up %d refresh tokens", deleted)
+			}
+		}
+	}()
+}
+
 func LogoutHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
@@ -186,34 +490,25 @@ func LogoutHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(req.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return refreshSecretKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		userID, err := parseRefreshToken(req.RefreshToken)
+		if err != nil {
 			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
 			return
 		}
 
-		result, err := db.Exec("DELETE FROM refresh_tokens WHERE token = $1", req.RefreshToken)
-		if err != nil {
-			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		var familyID string
+		err = db.QueryRow("DELETE FROM refresh_tokens WHERE token = $1 RETURNING family_id", req.RefreshToken).
+			Scan(&familyID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Refresh token not found", http.StatusUnauthorized)
 			return
 		}
-
-		rowsAffected, err := result.RowsAffected()
 		if err != nil {
-			http.Error(w, "Failed to check logout status", http.StatusInternalServerError)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
 			return
 		}
 
-		if rowsAffected == 0 {
-			http.Error(w, "Refresh token not found", http.StatusUnauthorized)
-			return
-		}
+		forgetSessions(userID, familyID)
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Logged out successfully"))
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+func initTestKeys(t *testing.T) {
+	t.Helper()
+	for _, kind := range []string{"ACCESS", "REFRESH"} {
+		t.Setenv("JWT_"+kind+"_KEYS_FILE", "")
+		t.Setenv("JWT_"+kind+"_KEYS", "")
+	}
+	t.Setenv("JWT_ACCESS_SECRET", "access-secret-for-tests-0123456789abcdef")
+	t.Setenv("JWT_REFRESH_SECRET", "refresh-secret-for-tests-0123456789abcdef")
+	if err := services.InitSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTokenAcceptsIssuedTokens(t *testing.T) {
+	initTestKeys(t)
+
+	access, err := createAccessToken(42, "session-1", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, userID, err := parseAccessToken(access)
+	if err != nil {
+		t.Fatalf("parseAccessToken: %v", err)
+	}
+	if userID != 42 || claims.SessionID != "session-1" || claims.Role != "admin" {
+		t.Errorf("got user %d, claims %+v", userID, claims)
+	}
+
+	refresh, err := createRefreshToken(42, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, err := parseRefreshToken(refresh); err != nil || userID != 42 {
+		t.Errorf("parseRefreshToken = %d, %v", userID, err)
+	}
+}
+
+func TestParseTokenRejectsTokenOfOtherType(t *testing.T) {
+	initTestKeys(t)
+
+	// A refresh token signed with the access keys must still not pass as
+	// an access token.
+	claims, err := newTokenClaims(42, "session-1", refreshTokenType, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := services.AccessKeys().Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseAccessToken(token); err == nil || !strings.Contains(err.Error(), "unexpected token type") {
+		t.Errorf("got error %v, want unexpected token type", err)
+	}
+
+	// And each kind is only checked against its own keys.
+	refresh, err := createRefreshToken(42, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseAccessToken(refresh); err == nil {
+		t.Error("refresh token was accepted as an access token")
+	}
+}
+
+func TestParseTokenRejectsBadClaims(t *testing.T) {
+	initTestKeys(t)
+
+	tests := []struct {
+		name   string
+		modify func(c *TokenClaims)
+		want   string
+	}{
+		{
+			name: "expired",
+			modify: func(c *TokenClaims) {
+				c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Hour))
+				c.NotBefore = c.IssuedAt
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			},
+			want: "invalid token",
+		},
+		{
+			name:   "not yet valid",
+			modify: func(c *TokenClaims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour)) },
+			want:   "invalid token",
+		},
+		{
+			name:   "wrong issuer",
+			modify: func(c *TokenClaims) { c.Issuer = "someone-else" },
+			want:   "invalid issuer or audience",
+		},
+		{
+			name:   "wrong audience",
+			modify: func(c *TokenClaims) { c.Audience = jwt.ClaimStrings{"another-app"} },
+			want:   "invalid issuer or audience",
+		},
+		{
+			name:   "missing jti",
+			modify: func(c *TokenClaims) { c.ID = "" },
+			want:   "missing required claims",
+		},
+		{
+			name:   "missing expiry",
+			modify: func(c *TokenClaims) { c.ExpiresAt = nil },
+			want:   "missing required claims",
+		},
+		{
+			name:   "non-numeric subject",
+			modify: func(c *TokenClaims) { c.Subject = "ada" },
+			want:   "invalid subject",
+		},
+		{
+			name:   "zero subject",
+			modify: func(c *TokenClaims) { c.Subject = "0" },
+			want:   "invalid subject",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := newTokenClaims(42, "session-1", accessTokenType, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(&claims)
+			token, err := services.AccessKeys().Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := parseAccessToken(token); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTokenRejectsForgedSignatures(t *testing.T) {
+	initTestKeys(t)
+
+	claims, err := newTokenClaims(42, "session-1", accessTokenType, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseAccessToken(unsigned); err == nil {
+		t.Error("unsigned token was accepted")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "default"
+	forged, err := token.SignedString([]byte("guessed-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseAccessToken(forged); err == nil {
+		t.Error("token signed with another secret was accepted")
+	}
+
+	valid, err := services.AccessKeys().Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseAccessToken(valid[:len(valid)-2]); err == nil {
+		t.Error("token with a truncated signature was accepted")
+	}
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+// BlockUser ends any buddy relationship with the target in both directions,
+// takes each out of the other's circles, closes pending requests between the
+// two, and stops new ones.
+func BlockUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, targetID, ok := parseUserTarget(db, w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`
+			INSERT INTO user_blocks (blocker_id, blocked_id, created_at)
+			VALUES ($1, $2, NOW())
+			ON CONFLICT (blocker_id, blocked_id) DO NOTHING`,
+			userID, targetID)
+		if err == nil {
+			_, err = tx.Exec(`
+				DELETE FROM buddies
+				WHERE (user_id = $1 AND buddy_id = $2) OR (user_id = $2 AND buddy_id = $1)`,
+				userID, targetID)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				DELETE FROM circle_members cm
+				USING circles c
+				WHERE cm.circle_id = c.id
+				  AND ((c.owner_id = $1 AND cm.member_id = $2) OR (c.owner_id = $2 AND cm.member_id = $1))`,
+				userID, targetID)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE buddy_requests
+				SET status = CASE WHEN requester_id = $1 THEN 'cancelled' ELSE 'declined' END,
+				    responded_at = NOW()
+				WHERE status = 'pending'
+				  AND ((requester_id = $1 AND recipient_id = $2) OR (requester_id = $2 AND recipient_id = $1))`,
+				userID, targetID)
+		}
+		if err != nil {
+			http.Error(w, "Failed to block user", http.StatusInternalServerError)
+			log.Println("BlockUser error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to block user", http.StatusInternalServerError)
+			log.Println("BlockUser commit error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "User blocked"})
+	}
+}
+
+// UnblockUser lifts a block. Former buddies have to send a new request.
+func UnblockUser(db *sql.DB) http.HandlerFunc {
+	return deleteUserRelation(db, `DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2`,
+		"Block not found", "User unblocked")
+}
+
+func GetBlockedUsers(db *sql.DB) http.HandlerFunc {
+	return listUserRelation(db, `
+		SELECT u.id, u.username, u.display_name
+		FROM user_blocks b
+		JOIN users u ON b.blocked_id = u.id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC`)
+}
+
+// MuteUser keeps the buddy but hides their posts from the feed and drops
+// notifications they would trigger.
+func MuteUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, targetID, ok := parseUserTarget(db, w, r)
+		if !ok {
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO user_mutes (muter_id, muted_id, created_at)
+			VALUES ($1, $2, NOW())
+			ON CONFLICT (muter_id, muted_id) DO NOTHING`,
+			userID, targetID)
+		if err != nil {
+			http.Error(w, "Failed to mute user", http.StatusInternalServerError)
+			log.Println("MuteUser error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "User muted"})
+	}
+}
+
+func UnmuteUser(db *sql.DB) http.HandlerFunc {
+	return deleteUserRelation(db, `DELETE FROM user_mutes WHERE muter_id = $1 AND muted_id = $2`,
+		"Mute not found", "User unmuted")
+}
+
+func GetMutedUsers(db *sql.DB) http.HandlerFunc {
+	return listUserRelation(db, `
+		SELECT u.id, u.username, u.display_name
+		FROM user_mutes m
+		JOIN users u ON m.muted_id = u.id
+		WHERE m.muter_id = $1
+		ORDER BY m.created_at DESC`)
+}
+
+// parseUserTarget reads {user_id} and the "user_id" field of the body for
+// block and mute requests, and checks that the target exists.
+func parseUserTarget(db *sql.DB, w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+	if !requireSelf(w, r, userID) {
+		return 0, 0, false
+	}
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if req.UserID == userID {
+		http.Error(w, "Cannot block or mute yourself", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, req.UserID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Println("parseUserTarget lookup error:", err)
+		return 0, 0, false
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, 0, false
+	}
+	return userID, req.UserID, true
+}
+
+func deleteUserRelation(db *sql.DB, query, notFound, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		targetID, _ := strconv.Atoi(vars["target_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		result, err := db.Exec(query, userID, targetID)
+		if err != nil {
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			log.Println("deleteUserRelation error:", err)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, notFound, http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	}
+}
+
+func listUserRelation(db *sql.DB, query string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		rows, err := db.Query(query, userID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("listUserRelation error:", err)
+			return
+		}
+		defer rows.Close()
+
+		users := []models.UserBuddies{}
+		for rows.Next() {
+			var u models.UserBuddies
+			if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName); err != nil {
+				http.Error(w, "Error scanning users", http.StatusInternalServerError)
+				log.Println("listUserRelation scan error:", err)
+				return
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating users", http.StatusInternalServerError)
+			log.Println("listUserRelation rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+// blockedBetween reports whether either user has blocked the other.
+func blockedBetween(db *sql.DB, a, b int) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_blocks
+		              WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))`,
+		a, b,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// hasMuted reports whether muterID has muted mutedID. Errors count as not
+// muted so a database hiccup does not swallow notifications.
+func hasMuted(db *sql.DB, muterID, mutedID int) bool {
+	var muted bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_mutes WHERE muter_id = $1 AND muted_id = $2)`,
+		muterID, mutedID,
+	).Scan(&muted)
+	if err != nil {
+		log.Printf("Error checking mute for user %d: %v", muterID, err)
+	}
+	return muted
+}
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+// CreateBuddyRequest asks another user to become buddies. Nothing is shared
+// until they accept. "mutual" defaults to true; set it to false to only ask
+// to see their posts without sharing yours.
+func CreateBuddyRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+
+		if !requireSelf(w, r, userID) || !requireVerifiedEmail(db, w, r) {
+			return
+		}
+
+		var req struct {
+			BuddyID int   `json:"buddy_id"`
+			Mutual  *bool `json:"mutual"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.BuddyID == userID {
+			http.Error(w, "Cannot add self as buddy", http.StatusBadRequest)
+			return
+		}
+		mutual := req.Mutual == nil || *req.Mutual
+
+		blocked, err := blockedBetween(db, userID, req.BuddyID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("CreateBuddyRequest block check error:", err)
+			return
+		}
+		if blocked {
+			http.Error(w, "You cannot send a buddy request to this user", http.StatusForbidden)
+			return
+		}
+
+		var buddyExists, alreadyBuddies, incoming bool
+		err = db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM users WHERE id = $2),
+			       EXISTS(SELECT 1 FROM buddies WHERE user_id = $1 AND buddy_id = $2),
+			       EXISTS(SELECT 1 FROM buddy_requests
+			              WHERE requester_id = $2 AND recipient_id = $1 AND status = 'pending')`,
+			userID, req.BuddyID,
+		).Scan(&buddyExists, &alreadyBuddies, &incoming)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("CreateBuddyRequest lookup error:", err)
+			return
+		}
+		if !buddyExists {
+			http.Error(w, "Buddy user not found", http.StatusNotFound)
+			return
+		}
+		if alreadyBuddies {
+			http.Error(w, "Already buddies", http.StatusConflict)
+			return
+		}
+		if incoming {
+			http.Error(w, "This user has already sent you a buddy request; accept it instead", http.StatusConflict)
+			return
+		}
+
+		br := models.BuddyRequest{
+			RequesterID: userID,
+			RecipientID: req.BuddyID,
+			Status:      models.BuddyRequestPending,
+			Mutual:      mutual,
+		}
+		err = db.QueryRow(`
+			INSERT INTO buddy_requests (requester_id, recipient_id, mutual, created_at)
+			VALUES ($1, $2, $3, NOW())
+			RETURNING id, created_at`,
+			userID, req.BuddyID, mutual,
+		).Scan(&br.ID, &br.CreatedAt)
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "A buddy request is already pending", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to send buddy request", http.StatusInternalServerError)
+			log.Println("CreateBuddyRequest error:", err)
+			return
+		}
+
+		go notifyUser(db, req.BuddyID, userID, "New Buddy Request", " wants to be your buddy", map[string]string{
+			"type":       "buddy_request",
+			"request_id": strconv.Itoa(br.ID),
+			"user_id":    strconv.Itoa(userID),
+		})
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(br)
+	}
+}
+
+// GetIncomingBuddyRequests lists pending requests sent to the user.
+func GetIncomingBuddyRequests(db *sql.DB) http.HandlerFunc {
+	return listBuddyRequests(db, `
+		SELECT br.id, br.requester_id, br.recipient_id, br.status, br.mutual, br.created_at,
+		       br.responded_at, u.username, u.display_name
+		FROM buddy_requests br
+		JOIN users u ON br.requester_id = u.id
+		WHERE br.recipient_id = $1 AND br.status = 'pending'
+		ORDER BY br.created_at DESC`)
+}
+
+// GetOutgoingBuddyRequests lists pending requests the user has sent.
+func GetOutgoingBuddyRequests(db *sql.DB) http.HandlerFunc {
+	return listBuddyRequests(db, `
+		SELECT br.id, br.requester_id, br.recipient_id, br.status, br.mutual, br.created_at,
+		       br.responded_at, u.username, u.display_name
+		FROM buddy_requests br
+		JOIN users u ON br.recipient_id = u.id
+		WHERE br.requester_id = $1 AND br.status = 'pending'
+		ORDER BY br.created_at DESC`)
+}
+
+func listBuddyRequests(db *sql.DB, query string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		rows, err := db.Query(query, userID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("listBuddyRequests error:", err)
+			return
+		}
+		defer rows.Close()
+
+		requests := []models.BuddyRequest{}
+		for rows.Next() {
+			var br models.BuddyRequest
+			if err := rows.Scan(&br.ID, &br.RequesterID, &br.RecipientID, &br.Status, &br.Mutual,
+				&br.CreatedAt, &br.RespondedAt, &br.Username, &br.DisplayName); err != nil {
+				http.Error(w, "Error scanning buddy requests", http.StatusInternalServerError)
+				log.Println("listBuddyRequests scan error:", err)
+				return
+			}
+			requests = append(requests, br)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating buddy requests", http.StatusInternalServerError)
+			log.Println("listBuddyRequests rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// AcceptBuddyRequest lets the requester see the recipient's posts, and the
+// other way round when the request is mutual.
+func AcceptBuddyRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		requestID, err := strconv.Atoi(vars["request_id"])
+		if err != nil {
+			http.Error(w, "Invalid request id", http.StatusBadRequest)
+			return
+		}
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var requesterID int
+		var mutual bool
+		err = tx.QueryRow(`
+			UPDATE buddy_requests
+			SET status = 'accepted', responded_at = NOW()
+			WHERE id = $1 AND recipient_id = $2 AND status = 'pending'
+			RETURNING requester_id, mutual`,
+			requestID, userID,
+		).Scan(&requesterID, &mutual)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pending buddy request not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to accept buddy request", http.StatusInternalServerError)
+			log.Println("AcceptBuddyRequest error:", err)
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO buddies (user_id, buddy_id)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id, buddy_id) DO NOTHING`,
+			requesterID, userID)
+		if err == nil && mutual {
+			_, err = tx.Exec(`
+				INSERT INTO buddies (user_id, buddy_id)
+				VALUES ($1, $2)
+				ON CONFLICT (user_id, buddy_id) DO NOTHING`,
+				userID, requesterID)
+		}
+		if err != nil {
+			http.Error(w, "Failed to accept buddy request", http.StatusInternalServerError)
+			log.Println("AcceptBuddyRequest insert error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to accept buddy request", http.StatusInternalServerError)
+			log.Println("AcceptBuddyRequest commit error:", err)
+			return
+		}
+
+		go notifyUser(db, requesterID, userID, "Buddy Request Accepted", " accepted your buddy request", map[string]string{
+			"type":       "buddy_request_accepted",
+			"request_id": strconv.Itoa(requestID),
+			"user_id":    strconv.Itoa(userID),
+		})
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Buddy request accepted"})
+	}
+}
+
+// DeclineBuddyRequest is used by the recipient. The requester is not told.
+func DeclineBuddyRequest(db *sql.DB) http.HandlerFunc {
+	return closeBuddyRequest(db, "recipient_id", models.BuddyRequestDeclined, "Buddy request declined")
+}
+
+// CancelBuddyRequest is used by the requester to withdraw a pending request.
+func CancelBuddyRequest(db *sql.DB) http.HandlerFunc {
+	return closeBuddyRequest(db, "requester_id", models.BuddyRequestCancelled, "Buddy request cancelled")
+}
+
+func closeBuddyRequest(db *sql.DB, ownerColumn, status, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		requestID, err := strconv.Atoi(vars["request_id"])
+		if err != nil {
+			http.Error(w, "Invalid request id", http.StatusBadRequest)
+			return
+		}
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE buddy_requests
+			SET status = $1, responded_at = NOW()
+			WHERE id = $2 AND `+ownerColumn+` = $3 AND status = 'pending'`,
+			status, requestID, userID)
+		if err != nil {
+			http.Error(w, "Failed to update buddy request", http.StatusInternalServerError)
+			log.Println("closeBuddyRequest error:", err)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Pending buddy request not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	}
+}
+
+// notifyUser pushes a notification to recipientID whose body starts with
+// actorID's display name, unless the recipient has muted them.
+func notifyUser(db *sql.DB, recipientID, actorID int, title, action string, data map[string]string) {
+	if hasMuted(db, recipientID, actorID) {
+		return
+	}
+
+	var displayName string
+	err := db.QueryRow(`SELECT display_name FROM users WHERE id = $1`, actorID).Scan(&displayName)
+	if err != nil {
+		log.Printf("Error fetching user display name for notifications: %v", err)
+		displayName = "Someone"
+	}
+
+	tokens, err := userFCMTokens(db, recipientID)
+	if err != nil {
+		log.Printf("Error fetching FCM tokens for user %d: %v", recipientID, err)
+		return
+	}
+	if len(tokens) == 0 {
+		return
+	}
+
+	if _, _, err := services.SendMultipleNotifications(tokens, title, displayName+action, data); err != nil {
+		log.Printf("Failed to send %s notification: %v", data["type"], err)
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+const (
+	defaultSuggestionLimit = 20
+	maxSuggestionLimit     = 50
+	// suggestionMutualNames is how many mutual buddies are named per
+	// suggestion; mutual_count has the full number.
+	suggestionMutualNames = 3
+)
+
+// GetBuddySuggestions ranks the buddies of the user's buddies by how many
+// buddies they share with the user. Existing buddies, people with a pending
+// request from the user and anyone blocked in either direction are left out.
+func GetBuddySuggestions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		limit := defaultSuggestionLimit
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = l
+		}
+		if limit > maxSuggestionLimit {
+			limit = maxSuggestionLimit
+		}
+
+		rows, err := db.Query(`
+			WITH candidates AS (
+				SELECT c.buddy_id AS id,
+				       COUNT(*) AS mutual_count,
+				       (ARRAY_AGG(mu.display_name ORDER BY mu.display_name, mu.id))[1:$3] AS mutual_names
+				FROM buddies m
+				JOIN buddies c ON c.user_id = m.buddy_id
+				JOIN users mu ON mu.id = m.buddy_id
+				WHERE m.user_id = $1
+				  AND c.buddy_id != $1
+				  AND NOT EXISTS(SELECT 1 FROM buddies b WHERE b.user_id = $1 AND b.buddy_id = c.buddy_id)
+				  AND NOT EXISTS(SELECT 1 FROM buddy_requests br
+				                 WHERE br.requester_id = $1 AND br.recipient_id = c.buddy_id
+				                   AND br.status = 'pending')
+				  AND NOT EXISTS(SELECT 1 FROM user_blocks ub
+				                 WHERE (ub.blocker_id = $1 AND ub.blocked_id = c.buddy_id)
+				                    OR (ub.blocker_id = c.buddy_id AND ub.blocked_id = $1))
+				GROUP BY c.buddy_id
+			)
+			SELECT u.id, u.username, u.display_name, s.mutual_count, s.mutual_names
+			FROM candidates s
+			JOIN users u ON u.id = s.id
+			ORDER BY s.mutual_count DESC, u.username
+			LIMIT $2`,
+			userID, limit, suggestionMutualNames)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetBuddySuggestions error:", err)
+			return
+		}
+		defer rows.Close()
+
+		suggestions := []models.BuddySuggestion{}
+		for rows.Next() {
+			var s models.BuddySuggestion
+			if err := rows.Scan(&s.ID, &s.Username, &s.DisplayName, &s.MutualCount,
+				pq.Array(&s.MutualBuddies)); err != nil {
+				http.Error(w, "Error scanning suggestions", http.StatusInternalServerError)
+				log.Println("GetBuddySuggestions scan error:", err)
+				return
+			}
+			suggestions = append(suggestions, s)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating suggestions", http.StatusInternalServerError)
+			log.Println("GetBuddySuggestions rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(suggestions)
+	}
+}
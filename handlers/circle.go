@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+const maxCircleNameLength = 50
+
+var (
+	errCircleNotFound  = errors.New("circle not found")
+	errCirclesNotBuddy = errors.New("circle_ids can only be used with buddies visibility")
+)
+
+// circleAllowsViewer is an SQL condition that is true when the post in
+// postColumn is not limited to circles, or viewerColumn is a member of one
+// of its circles.
+func circleAllowsViewer(postColumn, viewerColumn string) string {
+	return `(NOT EXISTS(SELECT 1 FROM post_circles pc WHERE pc.post_id = ` + postColumn + `)
+	         OR EXISTS(SELECT 1 FROM post_circles pc
+	                   JOIN circle_members cm ON cm.circle_id = pc.circle_id
+	                   WHERE pc.post_id = ` + postColumn + ` AND cm.member_id = ` + viewerColumn + `))`
+}
+
+func GetCircles(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT c.id, c.owner_id, c.name, c.created_at, u.id, u.username, u.display_name
+			FROM circles c
+			LEFT JOIN circle_members cm ON cm.circle_id = c.id
+			LEFT JOIN users u ON cm.member_id = u.id
+			WHERE c.owner_id = $1
+			ORDER BY c.name, c.id, u.display_name`,
+			userID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetCircles error:", err)
+			return
+		}
+		defer rows.Close()
+
+		circles := []models.Circle{}
+		for rows.Next() {
+			var c models.Circle
+			var memberID sql.NullInt64
+			var username, displayName sql.NullString
+			if err := rows.Scan(&c.ID, &c.OwnerID, &c.Name, &c.CreatedAt, &memberID, &username, &displayName); err != nil {
+				http.Error(w, "Error scanning circles", http.StatusInternalServerError)
+				log.Println("GetCircles scan error:", err)
+				return
+			}
+			if n := len(circles); n == 0 || circles[n-1].ID != c.ID {
+				c.Members = []models.UserBuddies{}
+				circles = append(circles, c)
+			}
+			if memberID.Valid {
+				last := &circles[len(circles)-1]
+				last.Members = append(last.Members, models.UserBuddies{
+					ID:          int(memberID.Int64),
+					Username:    username.String,
+					DisplayName: displayName.String,
+				})
+			}
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating circles", http.StatusInternalServerError)
+			log.Println("GetCircles rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(circles)
+	}
+}
+
+// validCircleName trims name and writes a 400 when it is empty or too long.
+func validCircleName(w http.ResponseWriter, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return "", false
+	}
+	if utf8.RuneCountInString(name) > maxCircleNameLength {
+		http.Error(w, fmt.Sprintf("name must be at most %d characters", maxCircleNameLength), http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+func CreateCircle(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		name, ok := validCircleName(w, req.Name)
+		if !ok {
+			return
+		}
+
+		c := models.Circle{OwnerID: userID, Name: name, Members: []models.UserBuddies{}}
+		err := db.QueryRow(`
+			INSERT INTO circles (owner_id, name, created_at)
+			VALUES ($1, $2, NOW())
+			RETURNING id, created_at`,
+			userID, name,
+		).Scan(&c.ID, &c.CreatedAt)
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "You already have a circle with that name", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to create circle", http.StatusInternalServerError)
+			log.Println("CreateCircle error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// RenameCircle changes a circle's name. Members and posts are unaffected.
+func RenameCircle(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		circleID, err := strconv.Atoi(vars["circle_id"])
+		if err != nil {
+			http.Error(w, "Invalid circle id", http.StatusBadRequest)
+			return
+		}
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		name, ok := validCircleName(w, req.Name)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec(`UPDATE circles SET name = $1 WHERE id = $2 AND owner_id = $3`, name, circleID, userID)
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "You already have a circle with that name", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to rename circle", http.StatusInternalServerError)
+			log.Println("RenameCircle error:", err)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Circle not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Circle renamed"})
+	}
+}
+
+// DeleteCircle removes a circle. Posts that were shared only with it become
+// private rather than opening up to every buddy.
+func DeleteCircle(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		circleID, err := strconv.Atoi(vars["circle_id"])
+		if err != nil {
+			http.Error(w, "Invalid circle id", http.StatusBadRequest)
+			return
+		}
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var exists bool
+		err = tx.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM circles WHERE id = $1 AND owner_id = $2)`,
+			circleID, userID,
+		).Scan(&exists)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("DeleteCircle error:", err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Circle not found", http.StatusNotFound)
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE posts SET visibility = 'private'
+			WHERE id IN (SELECT post_id FROM post_circles WHERE circle_id = $1)
+			  AND NOT EXISTS(SELECT 1 FROM post_circles pc WHERE pc.post_id = posts.id AND pc.circle_id <> $1)`,
+			circleID)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM circles WHERE id = $1`, circleID)
+		}
+		if err != nil {
+			http.Error(w, "Failed to delete circle", http.StatusInternalServerError)
+			log.Println("DeleteCircle error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete circle", http.StatusInternalServerError)
+			log.Println("DeleteCircle commit error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Circle deleted"})
+	}
+}
+
+// AddCircleMember puts one of the owner's buddies in a circle. Only people
+// who can see the owner's posts can be added, since that is who circles
+// narrow down.
+func AddCircleMember(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		circleID, err := strconv.Atoi(vars["circle_id"])
+		if err != nil {
+			http.Error(w, "Invalid circle id", http.StatusBadRequest)
+			return
+		}
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		var req struct {
+			UserID int `json:"user_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+
+		var ownsCircle, isBuddy bool
+		err = db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM circles WHERE id = $1 AND owner_id = $2),
+			       EXISTS(SELECT 1 FROM buddies WHERE user_id = $3 AND buddy_id = $2)`,
+			circleID, userID, req.UserID,
+		).Scan(&ownsCircle, &isBuddy)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("AddCircleMember lookup error:", err)
+			return
+		}
+		if !ownsCircle {
+			http.Error(w, "Circle not found", http.StatusNotFound)
+			return
+		}
+		if !isBuddy {
+			http.Error(w, "Only buddies can be added to a circle", http.StatusBadRequest)
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO circle_members (circle_id, member_id, created_at)
+			VALUES ($1, $2, NOW())
+			ON CONFLICT (circle_id, member_id) DO NOTHING`,
+			circleID, req.UserID)
+		if err != nil {
+			http.Error(w, "Failed to add circle member", http.StatusInternalServerError)
+			log.Println("AddCircleMember error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Added to circle"})
+	}
+}
+
+func RemoveCircleMember(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		circleID, err := strconv.Atoi(vars["circle_id"])
+		if err != nil {
+			http.Error(w, "Invalid circle id", http.StatusBadRequest)
+			return
+		}
+		memberID, _ := strconv.Atoi(vars["member_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM circle_members cm
+			USING circles c
+			WHERE cm.circle_id = c.id AND c.id = $1 AND c.owner_id = $2 AND cm.member_id = $3`,
+			circleID, userID, memberID)
+		if err != nil {
+			http.Error(w, "Failed to remove circle member", http.StatusInternalServerError)
+			log.Println("RemoveCircleMember error:", err)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Circle member not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Removed from circle"})
+	}
+}
+
+// checkPostCircles removes duplicates from circleIDs and makes sure ownerID
+// owns every circle in it.
+func checkPostCircles(db *sql.DB, ownerID int, circleIDs []int) ([]int, error) {
+	seen := map[int]bool{}
+	ids := []int64{}
+	unique := []int{}
+	for _, id := range circleIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, int64(id))
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) == 0 {
+		return unique, nil
+	}
+
+	var owned int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM circles WHERE owner_id = $1 AND id = ANY($2)`,
+		ownerID, pq.Array(ids),
+	).Scan(&owned)
+	if err != nil {
+		return nil, err
+	}
+	if owned != len(unique) {
+		return nil, errCircleNotFound
+	}
+	return unique, nil
+}
+
+// postCircleIDs returns the circles a post is limited to, if any.
+func postCircleIDs(db *sql.DB, postID int) ([]int, error) {
+	rows, err := db.Query(`SELECT circle_id FROM post_circles WHERE post_id = $1 ORDER BY circle_id`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// attachCircleIDs fills in CircleIDs for each of the author's own posts.
+func attachCircleIDs(db *sql.DB, posts []models.Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(posts))
+	byID := make(map[int]*models.Post, len(posts))
+	for i := range posts {
+		ids[i] = int64(posts[i].ID)
+		byID[posts[i].ID] = &posts[i]
+	}
+
+	rows, err := db.Query(`
+		SELECT post_id, circle_id
+		FROM post_circles
+		WHERE post_id = ANY($1)
+		ORDER BY post_id, circle_id`,
+		pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID, circleID int
+		if err := rows.Scan(&postID, &circleID); err != nil {
+			return err
+		}
+		p := byID[postID]
+		p.CircleIDs = append(p.CircleIDs, circleID)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const maxCommentLength = 500
+
+// GetComments returns a post's comments oldest first, with replies nested
+// under the comment they answer.
+func GetComments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid post id", http.StatusBadRequest)
+			return
+		}
+		userID, _ := UserIDFromContext(r.Context())
+		if _, ok := requirePostAccess(db, w, postID, userID); !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT c.id, c.post_id, c.user_id, c.parent_id, c.text, c.created_at,
+			       u.username, u.display_name
+			FROM comments c
+			JOIN users u ON c.user_id = u.id
+			WHERE c.post_id = $1
+			ORDER BY c.created_at, c.id`,
+			postID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetComments error:", err)
+			return
+		}
+		defer rows.Close()
+
+		var top []models.Comment
+		replies := map[int][]models.Comment{}
+		for rows.Next() {
+			var c models.Comment
+			var parentID sql.NullInt64
+			if err := rows.Scan(&c.ID, &c.PostID, &c.UserID, &parentID, &c.Text, &c.CreatedAt,
+				&c.Username, &c.DisplayName); err != nil {
+				http.Error(w, "Error scanning comments", http.StatusInternalServerError)
+				log.Println("GetComments scan error:", err)
+				return
+			}
+			if parentID.Valid {
+				id := int(parentID.Int64)
+				c.ParentID = &id
+				replies[id] = append(replies[id], c)
+			} else {
+				top = append(top, c)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating comments", http.StatusInternalServerError)
+			log.Println("GetComments rows error:", err)
+			return
+		}
+
+		comments := []models.Comment{}
+		for _, c := range top {
+			c.Replies = replies[c.ID]
+			comments = append(comments, c)
+		}
+
+		json.NewEncoder(w).Encode(comments)
+	}
+}
+
+// CreateComment adds a comment to a post. Set parent_id to reply to a
+// top-level comment; replies to replies are not allowed.
+func CreateComment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid post id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Text     string `json:"text"`
+			ParentID *int   `json:"parent_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Text = strings.TrimSpace(req.Text)
+		if req.Text == "" {
+			http.Error(w, "text is required", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Text) > maxCommentLength {
+			http.Error(w, fmt.Sprintf("text must be at most %d characters", maxCommentLength), http.StatusBadRequest)
+			return
+		}
+
+		userID, _ := UserIDFromContext(r.Context())
+		if !requireVerifiedEmail(db, w, r) {
+			return
+		}
+		ownerID, ok := requirePostAccess(db, w, postID, userID)
+		if !ok {
+			return
+		}
+
+		parentAuthorID := 0
+		if req.ParentID != nil {
+			var grandparentID sql.NullInt64
+			err := db.QueryRow(`
+				SELECT user_id, parent_id FROM comments WHERE id = $1 AND post_id = $2`,
+				*req.ParentID, postID,
+			).Scan(&parentAuthorID, &grandparentID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Parent comment not found", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("CreateComment parent error:", err)
+				return
+			}
+			if grandparentID.Valid {
+				http.Error(w, "Replies cannot be replied to", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c := models.Comment{PostID: postID, UserID: userID, ParentID: req.ParentID, Text: req.Text}
+		err = db.QueryRow(`
+			INSERT INTO comments (post_id, user_id, parent_id, text, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			RETURNING id, created_at`,
+			postID, userID, req.ParentID, req.Text,
+		).Scan(&c.ID, &c.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+			log.Println("CreateComment error:", err)
+			return
+		}
+
+		err = db.QueryRow(`SELECT username, display_name FROM users WHERE id = $1`, userID).
+			Scan(&c.Username, &c.DisplayName)
+		if err != nil {
+			log.Println("CreateComment user lookup error:", err)
+		}
+
+		go notifyOfComment(db, c, ownerID, parentAuthorID)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// DeleteComment removes a comment and its replies. The comment's author and
+// the post's author may delete it.
+func DeleteComment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		postID, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid post id", http.StatusBadRequest)
+			return
+		}
+		commentID, err := strconv.Atoi(vars["commentId"])
+		if err != nil {
+			http.Error(w, "Invalid comment id", http.StatusBadRequest)
+			return
+		}
+		userID, _ := UserIDFromContext(r.Context())
+
+		var authorID, postOwnerID int
+		err = db.QueryRow(`
+			SELECT c.user_id, p.user_id
+			FROM comments c
+			JOIN posts p ON c.post_id = p.id
+			WHERE c.id = $1 AND c.post_id = $2`,
+			commentID, postID,
+		).Scan(&authorID, &postOwnerID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Comment not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("DeleteComment error:", err)
+			}
+			return
+		}
+		if userID != authorID && userID != postOwnerID {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if _, err := db.Exec(`DELETE FROM comments WHERE id = $1`, commentID); err != nil {
+			http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+			log.Println("DeleteComment error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted successfully"})
+	}
+}
+
+// attachCommentCounts fills in CommentCount for each post.
+func attachCommentCounts(db *sql.DB, posts []models.PostWithUser) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(posts))
+	byID := make(map[int]*models.PostWithUser, len(posts))
+	for i := range posts {
+		ids[i] = int64(posts[i].ID)
+		byID[posts[i].ID] = &posts[i]
+	}
+
+	rows, err := db.Query(`
+		SELECT post_id, COUNT(*)
+		FROM comments
+		WHERE post_id = ANY($1)
+		GROUP BY post_id`,
+		pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID, count int
+		if err := rows.Scan(&postID, &count); err != nil {
+			return err
+		}
+		byID[postID].CommentCount = count
+	}
+	return rows.Err()
+}
+
+// notifyOfComment tells the post's author about a new comment, and the
+// parent comment's author about a reply. Nobody is notified of their own
+// comment, nor of one by someone they muted.
+func notifyOfComment(db *sql.DB, c models.Comment, postOwnerID, parentAuthorID int) {
+	displayName := c.DisplayName
+	if displayName == "" {
+		displayName = "A friend"
+	}
+
+	body := notificationPreview(c.Text)
+
+	data := map[string]string{
+		"type":       "comment",
+		"post_id":    strconv.Itoa(c.PostID),
+		"comment_id": strconv.Itoa(c.ID),
+		"user_id":    strconv.Itoa(c.UserID),
+	}
+
+	recipients := map[int]string{}
+	if postOwnerID != c.UserID {
+		recipients[postOwnerID] = fmt.Sprintf("%s commented on your post", displayName)
+	}
+	if parentAuthorID != 0 && parentAuthorID != c.UserID && parentAuthorID != postOwnerID {
+		recipients[parentAuthorID] = fmt.Sprintf("%s replied to your comment", displayName)
+	}
+
+	for recipientID, title := range recipients {
+		if hasMuted(db, recipientID, c.UserID) {
+			continue
+		}
+
+		tokens, err := userFCMTokens(db, recipientID)
+		if err != nil {
+			log.Printf("Error fetching FCM tokens for user %d: %v", recipientID, err)
+			continue
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if _, _, err := services.SendMultipleNotifications(tokens, title, body, data); err != nil {
+			log.Printf("Failed to send comment notification: %v", err)
+		}
+	}
+}
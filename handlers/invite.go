@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+const (
+	defaultInviteMaxUses = 5
+	maxInviteMaxUses     = 100
+	defaultInviteDays    = 14
+	maxInviteDays        = 90
+	inviteCodeLength     = 8
+	// inviteCodeAlphabet leaves out 0/O and 1/I so codes survive being read
+	// out loud or typed from a screenshot.
+	inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	defaultInviteStatsDays = 30
+	inviteStatsTopInviters = 10
+)
+
+var (
+	errInviteInvalid  = errors.New("invite code is invalid, expired or used up")
+	errInviteOwn      = errors.New("you cannot redeem your own invite")
+	errInviteBlocked  = errors.New("you cannot redeem this invite")
+	errInviteRedeemed = errors.New("you have already redeemed this invite")
+)
+
+// inviteErrorStatus maps redeemInvite errors to a response status.
+func inviteErrorStatus(err error) int {
+	switch err {
+	case errInviteInvalid:
+		return http.StatusNotFound
+	case errInviteOwn:
+		return http.StatusBadRequest
+	case errInviteBlocked:
+		return http.StatusForbidden
+	case errInviteRedeemed:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, inviteCodeLength)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = inviteCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// normalizeInviteCode makes codes case-insensitive and forgiving of stray
+// whitespace.
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func inviteURL(code string) string {
+	return appURL("/invite/" + code)
+}
+
+// CreateInvite issues a shareable code. Whoever redeems it becomes mutual
+// buddies with the inviter.
+func CreateInvite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) || !requireVerifiedEmail(db, w, r) {
+			return
+		}
+
+		var req struct {
+			MaxUses       int `json:"max_uses"`
+			ExpiresInDays int `json:"expires_in_days"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.MaxUses == 0 {
+			req.MaxUses = defaultInviteMaxUses
+		}
+		if req.MaxUses < 1 || req.MaxUses > maxInviteMaxUses {
+			http.Error(w, fmt.Sprintf("max_uses must be between 1 and %d", maxInviteMaxUses), http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = defaultInviteDays
+		}
+		if req.ExpiresInDays < 1 || req.ExpiresInDays > maxInviteDays {
+			http.Error(w, fmt.Sprintf("expires_in_days must be between 1 and %d", maxInviteDays), http.StatusBadRequest)
+			return
+		}
+
+		inv := models.Invite{InviterID: userID, MaxUses: req.MaxUses, Active: true}
+		// Codes are short, so retry the rare collision rather than fail.
+		for attempt := 0; ; attempt++ {
+			code, err := newInviteCode()
+			if err != nil {
+				http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+				log.Println("CreateInvite code error:", err)
+				return
+			}
+			err = db.QueryRow(`
+				INSERT INTO invites (inviter_id, code, max_uses, expires_at, created_at)
+				VALUES ($1, $2, $3, NOW() + make_interval(days => $4), NOW())
+				RETURNING id, code, expires_at, created_at`,
+				userID, code, req.MaxUses, req.ExpiresInDays,
+			).Scan(&inv.ID, &inv.Code, &inv.ExpiresAt, &inv.CreatedAt)
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && attempt < 3 {
+				continue
+			}
+			if err != nil {
+				http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+				log.Println("CreateInvite error:", err)
+				return
+			}
+			break
+		}
+		inv.URL = inviteURL(inv.Code)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(inv)
+	}
+}
+
+// GetInvites lists every invite the user has issued, newest first, with how
+// often each was used.
+func GetInvites(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT i.id, i.inviter_id, i.code, i.max_uses, i.use_count,
+			       (SELECT COUNT(*) FROM invite_redemptions ir WHERE ir.invite_id = i.id AND ir.new_user),
+			       i.revoked_at IS NULL AND i.expires_at > NOW() AND i.use_count < i.max_uses,
+			       i.expires_at, i.revoked_at, i.created_at
+			FROM invites i
+			WHERE i.inviter_id = $1
+			ORDER BY i.created_at DESC`,
+			userID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetInvites error:", err)
+			return
+		}
+		defer rows.Close()
+
+		invites := []models.Invite{}
+		for rows.Next() {
+			var inv models.Invite
+			if err := rows.Scan(&inv.ID, &inv.InviterID, &inv.Code, &inv.MaxUses, &inv.UseCount,
+				&inv.SignupCount, &inv.Active, &inv.ExpiresAt, &inv.RevokedAt, &inv.CreatedAt); err != nil {
+				http.Error(w, "Error scanning invites", http.StatusInternalServerError)
+				log.Println("GetInvites scan error:", err)
+				return
+			}
+			inv.URL = inviteURL(inv.Code)
+			invites = append(invites, inv)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating invites", http.StatusInternalServerError)
+			log.Println("GetInvites rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(invites)
+	}
+}
+
+// RevokeInvite stops a code from being redeemed. The invite is kept so its
+// past uses still count towards metrics.
+func RevokeInvite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, _ := strconv.Atoi(vars["user_id"])
+		inviteID, err := strconv.Atoi(vars["invite_id"])
+		if err != nil {
+			http.Error(w, "Invalid invite id", http.StatusBadRequest)
+			return
+		}
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE invites SET revoked_at = NOW()
+			WHERE id = $1 AND inviter_id = $2 AND revoked_at IS NULL`,
+			inviteID, userID)
+		if err != nil {
+			http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+			log.Println("RevokeInvite error:", err)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Invite revoked"})
+	}
+}
+
+// GetInvitePreview lets the sign-up screen show who sent a code before the
+// holder has an account.
+func GetInvitePreview(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := normalizeInviteCode(mux.Vars(r)["code"])
+
+		p := models.InvitePreview{Code: code}
+		err := db.QueryRow(`
+			SELECT u.username, u.display_name, i.expires_at
+			FROM invites i
+			JOIN users u ON i.inviter_id = u.id
+			WHERE i.code = $1 AND i.revoked_at IS NULL
+			  AND i.expires_at > NOW() AND i.use_count < i.max_uses`,
+			code,
+		).Scan(&p.Username, &p.DisplayName, &p.ExpiresAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, errInviteInvalid.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetInvitePreview error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// RedeemInvite is for people who already have an account.
+func RedeemInvite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		if !requireSelf(w, r, userID) || !requireVerifiedEmail(db, w, r) {
+			return
+		}
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+			http.Error(w, "code is required", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		inviterID, err := redeemInvite(tx, req.Code, userID, false)
+		if err != nil {
+			status := inviteErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				http.Error(w, "Failed to redeem invite", status)
+				log.Println("RedeemInvite error:", err)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to redeem invite", http.StatusInternalServerError)
+			log.Println("RedeemInvite commit error:", err)
+			return
+		}
+
+		go notifyInviter(db, inviterID, userID, false)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":  "Invite redeemed",
+			"buddy_id": inviterID,
+		})
+	}
+}
+
+// redeemInvite uses up one redemption of code for userID and makes them
+// mutual buddies with the inviter, settling any pending request between
+// them. It returns the inviter's id.
+func redeemInvite(tx *sql.Tx, code string, userID int, newUser bool) (int, error) {
+	var inviteID, inviterID int
+	err := tx.QueryRow(`
+		SELECT id, inviter_id FROM invites
+		WHERE code = $1 AND revoked_at IS NULL
+		  AND expires_at > NOW() AND use_count < max_uses
+		FOR UPDATE`,
+		normalizeInviteCode(code),
+	).Scan(&inviteID, &inviterID)
+	if err == sql.ErrNoRows {
+		return 0, errInviteInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if inviterID == userID {
+		return 0, errInviteOwn
+	}
+
+	var blocked bool
+	err = tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_blocks
+		              WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))`,
+		inviterID, userID,
+	).Scan(&blocked)
+	if err != nil {
+		return 0, err
+	}
+	if blocked {
+		return 0, errInviteBlocked
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO invite_redemptions (invite_id, user_id, new_user, created_at)
+		VALUES ($1, $2, $3, NOW())`,
+		inviteID, userID, newUser)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return 0, errInviteRedeemed
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE invites SET use_count = use_count + 1 WHERE id = $1`, inviteID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO buddies (user_id, buddy_id)
+			VALUES ($1, $2), ($2, $1)
+			ON CONFLICT (user_id, buddy_id) DO NOTHING`,
+			inviterID, userID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE buddy_requests
+			SET status = 'accepted', responded_at = NOW()
+			WHERE status = 'pending'
+			  AND ((requester_id = $1 AND recipient_id = $2) OR (requester_id = $2 AND recipient_id = $1))`,
+			inviterID, userID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return inviterID, nil
+}
+
+func notifyInviter(db *sql.DB, inviterID, userID int, newUser bool) {
+	action := " accepted your invite"
+	if newUser {
+		action = " joined with your invite"
+	}
+	notifyUser(db, inviterID, userID, "Invite Accepted", action, map[string]string{
+		"type":    "invite_redeemed",
+		"user_id": strconv.Itoa(userID),
+	})
+}
+
+// GetInviteStats summarises invite use over the last ?days (default 30) for
+// growth reporting.
+func GetInviteStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days := defaultInviteStatsDays
+		if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 {
+			days = d
+		}
+		since := time.Now().AddDate(0, 0, -days)
+
+		stats := models.InviteStats{Days: days, TopInviters: []models.InviterStats{}}
+		err := db.QueryRow(`
+			SELECT (SELECT COUNT(*) FROM invites WHERE created_at >= $1),
+			       COUNT(*),
+			       COUNT(*) FILTER (WHERE new_user)
+			FROM invite_redemptions
+			WHERE created_at >= $1`,
+			since,
+		).Scan(&stats.InvitesIssued, &stats.Redemptions, &stats.Signups)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetInviteStats error:", err)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT u.id, u.username, u.display_name,
+			       COUNT(*) AS redemptions,
+			       COUNT(*) FILTER (WHERE ir.new_user) AS signups
+			FROM invite_redemptions ir
+			JOIN invites i ON ir.invite_id = i.id
+			JOIN users u ON i.inviter_id = u.id
+			WHERE ir.created_at >= $1
+			GROUP BY u.id, u.username, u.display_name
+			ORDER BY signups DESC, redemptions DESC, u.id
+			LIMIT $2`,
+			since, inviteStatsTopInviters)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetInviteStats inviters error:", err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var s models.InviterStats
+			if err := rows.Scan(&s.ID, &s.Username, &s.DisplayName, &s.Redemptions, &s.Signups); err != nil {
+				http.Error(w, "Error scanning invite stats", http.StatusInternalServerError)
+				log.Println("GetInviteStats scan error:", err)
+				return
+			}
+			stats.TopInviters = append(stats.TopInviters, s)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating invite stats", http.StatusInternalServerError)
+			log.Println("GetInviteStats rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+type contextKey string
+
+const (
+	userIDContextKey    contextKey = "user_id"
+	sessionIDContextKey contextKey = "session_id"
+	roleContextKey      contextKey = "role"
+)
+
+// AuthMiddleware validates the bearer access token on every request that
+// reaches the router it is attached to and stores the caller's user ID in
+// the request context. Personal access tokens are refused.
+func AuthMiddleware(db *sql.DB) mux.MiddlewareFunc {
+	return authenticate(db, "")
+}
+
+// ScopedAuthMiddleware behaves like AuthMiddleware but also accepts personal
+// access tokens that were granted scope.
+func ScopedAuthMiddleware(db *sql.DB, scope string) mux.MiddlewareFunc {
+	return authenticate(db, scope)
+}
+
+func authenticate(db *sql.DB, scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, ok := bearerToken(r)
+			if !ok {
+				http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+				return
+			}
+
+			if isPersonalAccessToken(tokenString) {
+				if scope == "" {
+					http.Error(w, "Personal access tokens cannot be used here", http.StatusForbidden)
+					return
+				}
+
+				userID, role, err := authenticatePersonalAccessToken(db, tokenString, scope)
+				if err != nil {
+					if err == errMissingScope {
+						http.Error(w, "Token is missing the "+scope+" scope", http.StatusForbidden)
+					} else {
+						http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+					}
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), userIDContextKey, userID)
+				ctx = context.WithValue(ctx, roleContextKey, role)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			claims, userID, err := parseAccessToken(tokenString)
+			if err != nil {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+
+			active, err := sessionActive(db, userID, claims.SessionID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				log.Println("authenticate session lookup error:", err)
+				return
+			}
+			if !active {
+				http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userIDContextKey, userID)
+			ctx = context.WithValue(ctx, sessionIDContextKey, claims.SessionID)
+			ctx = context.WithValue(ctx, roleContextKey, claims.Role)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// UserIDFromContext returns the authenticated caller set by AuthMiddleware.
+func UserIDFromContext(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(int)
+	return userID, ok
+}
+
+// RoleFromContext returns the caller's role from their access token.
+func RoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roleContextKey).(string)
+	return role
+}
+
+// RequireRole only lets callers with one of roles through. It must run after
+// AuthMiddleware.
+func RequireRole(roles ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := RoleFromContext(r.Context())
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+func sessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDContextKey).(string)
+	return sessionID
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	return token, token != ""
+}
+
+var (
+	trustedProxies     []*net.IPNet
+	trustedProxiesOnce sync.Once
+)
+
+// currentTrustedProxies reads TRUSTED_PROXIES, a comma separated list of IPs
+// or CIDR ranges of the proxies in front of us, on first use.
+func currentTrustedProxies() []*net.IPNet {
+	trustedProxiesOnce.Do(func() {
+		trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	})
+	return trustedProxies
+}
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is
+// only believed when the connection comes from a trusted proxy, and then the
+// right-most hop that is not one of our proxies is used, since anything to
+// its left was written by the client.
+func clientIP(r *http.Request) string {
+	return resolveClientIP(r, currentTrustedProxies())
+}
+
+func resolveClientIP(r *http.Request, proxies []*net.IPNet) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !isTrustedProxy(proxies, remote) {
+		return remote
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !isTrustedProxy(proxies, hop) {
+			return hop
+		}
+	}
+	return remote
+}
+
+// requireSelf rejects the request with 403 unless the caller is userID.
+func requireSelf(w http.ResponseWriter, r *http.Request, userID int) bool {
+	callerID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if callerID != userID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+func SetUserRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Role {
+		case models.RoleUser, models.RoleModerator, models.RoleAdmin:
+		default:
+			http.Error(w, "role must be one of user, moderator, admin", http.StatusBadRequest)
+			return
+		}
+
+		callerID, _ := UserIDFromContext(r.Context())
+		if callerID == id && req.Role != models.RoleAdmin {
+			http.Error(w, "Admins cannot demote themselves", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("SetUserRole begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec("UPDATE users SET role = $1 WHERE id = $2", req.Role, id)
+		if err != nil {
+			http.Error(w, "Failed to update role", http.StatusInternalServerError)
+			log.Println("SetUserRole update error:", err)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		// Access tokens carry the role, so make the user sign in again to pick
+		// up the new one.
+		if _, err := revokeUserSessions(tx, id, ""); err != nil {
+			http.Error(w, "Failed to update role", http.StatusInternalServerError)
+			log.Println("SetUserRole revoke sessions error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to update role", http.StatusInternalServerError)
+			log.Println("SetUserRole commit error:", err)
+			return
+		}
+		forgetSessions(id, "")
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Role updated successfully"})
+	}
+}
+
+func ModerateDeletePost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		// The photos go too, so the author cannot attach them to a new post.
+		found, err := deletePostWithPhotos(db, id)
+		if err != nil {
+			http.Error(w, "Failed to delete post", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !found {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+
+		moderatorID, _ := UserIDFromContext(r.Context())
+		log.Printf("Post %s removed by moderator %d", id, moderatorID)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Post removed",
+		})
+	}
+}
@@ -28,7 +28,10 @@ func RegisterTokenHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		if req.UserID == 0 {
-			http.Error(w, "Valid user_id is required", http.StatusBadRequest)
+			req.UserID, _ = UserIDFromContext(r.Context())
+		}
+
+		if !requireSelf(w, r, req.UserID) {
 			return
 		}
 
@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+	"masterboxer.com/project-micro-journal/models"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const (
+	oidcSignupTokenType = "oidc_signup"
+	oidcSignupTTL       = 15 * time.Minute
+)
+
+// oidcSignupClaims carry a verified external identity from OIDCLoginHandler
+// to OIDCSignupHandler while the user fills in the rest of their profile.
+type oidcSignupClaims struct {
+	TokenType     string `json:"typ"`
+	Provider      string `json:"provider"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	jwt.RegisteredClaims
+}
+
+func createOIDCSignupToken(provider string, claims *services.OIDCClaims) (string, error) {
+	jti, err := randomTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return services.AccessKeys().Sign(oidcSignupClaims{
+		TokenType:     oidcSignupTokenType,
+		Provider:      provider,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   claims.Subject,
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{tokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcSignupTTL)),
+			ID:        jti,
+		},
+	})
+}
+
+func parseOIDCSignupToken(tokenString string) (*oidcSignupClaims, error) {
+	keys := services.AccessKeys()
+	claims := &oidcSignupClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc,
+		jwt.WithValidMethods(keys.Methods()))
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if claims.TokenType != oidcSignupTokenType {
+		return nil, fmt.Errorf("unexpected token type: %q", claims.TokenType)
+	}
+	if !claims.VerifyIssuer(tokenIssuer, true) || !claims.VerifyAudience(tokenAudience, true) {
+		return nil, fmt.Errorf("invalid issuer or audience")
+	}
+	if claims.Subject == "" || claims.Provider == "" || claims.Email == "" {
+		return nil, fmt.Errorf("missing required claims")
+	}
+	return claims, nil
+}
+
+func GetOIDCProviders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type providerInfo struct {
+			Name                  string `json:"name"`
+			Issuer                string `json:"issuer"`
+			ClientID              string `json:"client_id"`
+			AuthorizationEndpoint string `json:"authorization_endpoint,omitempty"`
+		}
+
+		providers := []providerInfo{}
+		for _, name := range services.OIDCProviderNames() {
+			p, _ := services.GetOIDCProvider(name)
+			info := providerInfo{Name: p.Name, Issuer: p.Issuer, ClientID: p.ClientIDs[0]}
+
+			endpoint, err := p.AuthorizationEndpoint(r.Context())
+			if err != nil {
+				log.Printf("GetOIDCProviders discovery error for %s: %v", name, err)
+			}
+			info.AuthorizationEndpoint = endpoint
+
+			providers = append(providers, info)
+		}
+
+		json.NewEncoder(w).Encode(providers)
+	}
+}
+
+// OIDCLoginHandler signs in with an ID token from an external provider. The
+// client either sends the id_token it got from a native SDK, or the code from
+// an authorization code flow for us to redeem.
+//
+// An identity that is already linked signs in its user. Otherwise, a user whose
+// email matches and is verified on both sides gets the identity linked to them.
+// Anyone else receives a signup_token to finish registration with
+// OIDCSignupHandler.
+func OIDCLoginHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		providerName := mux.Vars(r)["provider"]
+		provider, ok := services.GetOIDCProvider(providerName)
+		if !ok {
+			http.Error(w, "Unknown provider", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			IDToken      string `json:"id_token"`
+			Code         string `json:"code"`
+			RedirectURI  string `json:"redirect_uri"`
+			CodeVerifier string `json:"code_verifier"`
+			Nonce        string `json:"nonce"`
+			DeviceName   string `json:"device_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		rawIDToken := req.IDToken
+		if rawIDToken == "" {
+			if req.Code == "" || req.RedirectURI == "" {
+				http.Error(w, "id_token, or code and redirect_uri, are required", http.StatusBadRequest)
+				return
+			}
+
+			var err error
+			rawIDToken, err = provider.Exchange(r.Context(), req.Code, req.RedirectURI, req.CodeVerifier)
+			if err != nil {
+				http.Error(w, "Could not redeem authorization code", http.StatusUnauthorized)
+				log.Printf("OIDCLoginHandler exchange error for %s: %v", providerName, err)
+				return
+			}
+		}
+
+		claims, err := provider.VerifyIDToken(r.Context(), rawIDToken, req.Nonce)
+		if err != nil {
+			http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+			log.Printf("OIDCLoginHandler verify error for %s: %v", providerName, err)
+			return
+		}
+
+		var user models.User
+		var totpEnabled bool
+		err = db.QueryRow(`
+			SELECT u.id, u.username, u.display_name, u.email, u.role, u.totp_enabled
+			FROM identities i
+			JOIN users u ON u.id = i.user_id
+			WHERE i.provider = $1 AND i.subject = $2`,
+			providerName, claims.Subject).
+			Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Role, &totpEnabled)
+		if err == nil {
+			_, err = db.Exec(`
+				UPDATE identities SET email = $1, last_login_at = NOW()
+				WHERE provider = $2 AND subject = $3`,
+				claims.Email, providerName, claims.Subject)
+			if err != nil {
+				log.Println("OIDCLoginHandler identity update error:", err)
+			}
+
+			completeLogin(w, r, db, user, totpEnabled, req.DeviceName)
+			return
+		}
+		if err != sql.ErrNoRows {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("OIDCLoginHandler identity lookup error:", err)
+			return
+		}
+
+		if claims.Email == "" {
+			http.Error(w, "The provider did not share an email address", http.StatusBadRequest)
+			return
+		}
+
+		var emailVerified bool
+		err = db.QueryRow(`
+			SELECT id, username, display_name, email, role, totp_enabled, email_verified
+			FROM users WHERE email = $1`, claims.Email).
+			Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Role,
+				&totpEnabled, &emailVerified)
+		switch {
+		case err == sql.ErrNoRows:
+			signupToken, err := createOIDCSignupToken(providerName, claims)
+			if err != nil {
+				http.Error(w, "Could not create signup token", http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]string{
+				"signup_required": "true",
+				"signup_token":    signupToken,
+				"email":           claims.Email,
+				"display_name":    claims.Name,
+			})
+			return
+		case err != nil:
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("OIDCLoginHandler user lookup error:", err)
+			return
+		}
+
+		// Linking on an unverified address on either side would let whoever
+		// registered it first take over the other account.
+		if !bool(claims.EmailVerified) || !emailVerified {
+			http.Error(w, "An account with this email already exists. Sign in with your password first.", http.StatusConflict)
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO identities (user_id, provider, subject, email, last_login_at)
+			VALUES ($1, $2, $3, $4, NOW())`,
+			user.ID, providerName, claims.Subject, claims.Email)
+		if err != nil {
+			http.Error(w, "Failed to link account", http.StatusInternalServerError)
+			log.Println("OIDCLoginHandler link error:", err)
+			return
+		}
+
+		completeLogin(w, r, db, user, totpEnabled, req.DeviceName)
+	}
+}
+
+// OIDCSignupHandler creates an account for an external identity that did not
+// match anyone, using the profile fields the provider does not supply.
+func OIDCSignupHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			SignupToken           string           `json:"signup_token"`
+			Username              string           `json:"username"`
+			DisplayName           string           `json:"display_name"`
+			DOB                   models.CivilDate `json:"dob"`
+			Gender                string           `json:"gender"`
+			Timezone              string           `json:"timezone"`
+			DeviceName            string           `json:"device_name"`
+			DefaultPostVisibility string           `json:"default_post_visibility"`
+			InviteCode            string           `json:"invite_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := parseOIDCSignupToken(req.SignupToken)
+		if err != nil {
+			http.Error(w, "Invalid or expired signup token", http.StatusUnauthorized)
+			return
+		}
+
+		req.Username = strings.TrimSpace(req.Username)
+		req.DisplayName = strings.TrimSpace(req.DisplayName)
+		if req.Username == "" || req.DisplayName == "" {
+			http.Error(w, "Username and display_name are required", http.StatusBadRequest)
+			return
+		}
+
+		if time.Time(req.DOB).IsZero() {
+			http.Error(w, "Date of birth is required", http.StatusBadRequest)
+			return
+		}
+
+		if time.Time(req.DOB).After(time.Now()) {
+			http.Error(w, "Date of birth cannot be in the future", http.StatusBadRequest)
+			return
+		}
+
+		if req.Gender == "" {
+			http.Error(w, "Gender is required", http.StatusBadRequest)
+			return
+		}
+
+		if req.Timezone == "" {
+			req.Timezone = defaultTimezone
+		}
+		if !validTimezone(req.Timezone) {
+			http.Error(w, "timezone must be an IANA time zone such as Europe/Berlin", http.StatusBadRequest)
+			return
+		}
+
+		if req.DefaultPostVisibility == "" {
+			req.DefaultPostVisibility = models.VisibilityBuddies
+		}
+		if !validPostVisibility(req.DefaultPostVisibility) {
+			http.Error(w, "default_post_visibility must be private, buddies or public", http.StatusBadRequest)
+			return
+		}
+
+		// The account has no usable password until the user sets one through
+		// the password reset flow.
+		secret, err := randomToken(32)
+		if err != nil {
+			http.Error(w, "Could not create account", http.StatusInternalServerError)
+			return
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("OIDCSignupHandler begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		user := models.User{
+			Username:    req.Username,
+			DisplayName: req.DisplayName,
+			Email:       claims.Email,
+			Role:        models.RoleUser,
+		}
+		err = tx.QueryRow(`
+			INSERT INTO users (username, display_name, dob, gender, email, password,
+				email_verified, email_verified_at, timezone, default_post_visibility, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $7 THEN NOW() END, $8, $9, NOW())
+			RETURNING id`,
+			user.Username, user.DisplayName, req.DOB, req.Gender, user.Email,
+			string(hashedPassword), claims.EmailVerified, req.Timezone, req.DefaultPostVisibility,
+		).Scan(&user.ID)
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "Username, display name or email is already taken", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			log.Println("OIDCSignupHandler insert user error:", err)
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO identities (user_id, provider, subject, email, last_login_at)
+			VALUES ($1, $2, $3, $4, NOW())`,
+			user.ID, claims.Provider, claims.Subject, claims.Email)
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "This identity is already linked to an account", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			log.Println("OIDCSignupHandler insert identity error:", err)
+			return
+		}
+
+		// As in CreateUser, a bad invite code fails the sign-up.
+		inviterID := 0
+		if strings.TrimSpace(req.InviteCode) != "" {
+			inviterID, err = redeemInvite(tx, req.InviteCode, user.ID, true)
+			if err != nil {
+				status := inviteErrorStatus(err)
+				if status == http.StatusInternalServerError {
+					http.Error(w, "Failed to create user", status)
+					log.Println("OIDCSignupHandler invite error:", err)
+					return
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			log.Println("OIDCSignupHandler commit error:", err)
+			return
+		}
+
+		if !claims.EmailVerified {
+			go sendVerificationEmail(user.ID, user.Email)
+		}
+		if inviterID != 0 {
+			go notifyInviter(db, inviterID, user.ID, true)
+		}
+
+		writeLoginResponse(w, r, db, user, req.DeviceName)
+	}
+}
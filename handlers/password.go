@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const passwordResetTTL = time.Hour
+
+// PasswordPolicy is the strength requirement for new passwords, configured
+// through PASSWORD_MIN_LENGTH, PASSWORD_REQUIRE_MIXED_CASE,
+// PASSWORD_REQUIRE_DIGIT and PASSWORD_REQUIRE_SYMBOL.
+type PasswordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+var (
+	passwordPolicy     PasswordPolicy
+	passwordPolicyOnce sync.Once
+)
+
+// currentPasswordPolicy reads the policy on first use, after .env is loaded.
+func currentPasswordPolicy() PasswordPolicy {
+	passwordPolicyOnce.Do(func() {
+		passwordPolicy = PasswordPolicy{MinLength: 8}
+		if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+			passwordPolicy.MinLength = n
+		}
+		passwordPolicy.RequireMixedCase = os.Getenv("PASSWORD_REQUIRE_MIXED_CASE") == "true"
+		passwordPolicy.RequireDigit = os.Getenv("PASSWORD_REQUIRE_DIGIT") == "true"
+		passwordPolicy.RequireSymbol = os.Getenv("PASSWORD_REQUIRE_SYMBOL") == "true"
+	})
+	return passwordPolicy
+}
+
+// Validate returns a message suitable for the client when password is too weak.
+func (p PasswordPolicy) Validate(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d characters", p.MinLength)
+	}
+	// bcrypt ignores everything past 72 bytes.
+	if len(password) > 72 {
+		return fmt.Errorf("Password must be at most 72 bytes")
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c):
+			hasSymbol = true
+		}
+	}
+
+	if p.RequireMixedCase && !(hasUpper && hasLower) {
+		return fmt.Errorf("Password must contain both upper and lower case letters")
+	}
+	if p.RequireDigit && !hasDigit {
+		return fmt.Errorf("Password must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		return fmt.Errorf("Password must contain a symbol")
+	}
+	return nil
+}
+
+// appURL builds a link into the client app from APP_BASE_URL.
+func appURL(path string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:5000"
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+func ForgotPasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+
+		// The response is the same whether or not the account exists, so this
+		// endpoint cannot be used to discover registered emails.
+		response := map[string]string{
+			"message": "If an account exists for that email, a reset link has been sent",
+		}
+
+		var userID int
+		var email string
+		err := db.QueryRow("SELECT id, email FROM users WHERE email = $1", req.Email).Scan(&userID, &email)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println("ForgotPasswordHandler lookup error:", err)
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		token, err := randomToken(32)
+		if err != nil {
+			http.Error(w, "Could not create reset token", http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("ForgotPasswordHandler begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		// Only the most recent link is valid.
+		_, err = tx.Exec(`
+			UPDATE password_reset_tokens
+			SET used_at = NOW()
+			WHERE user_id = $1 AND used_at IS NULL`, userID)
+		if err != nil {
+			http.Error(w, "Could not create reset token", http.StatusInternalServerError)
+			log.Println("ForgotPasswordHandler invalidate error:", err)
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+			VALUES ($1, $2, $3)`,
+			userID, hashToken(token), time.Now().Add(passwordResetTTL))
+		if err != nil {
+			http.Error(w, "Could not create reset token", http.StatusInternalServerError)
+			log.Println("ForgotPasswordHandler insert error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Could not create reset token", http.StatusInternalServerError)
+			log.Println("ForgotPasswordHandler commit error:", err)
+			return
+		}
+
+		go func() {
+			body := fmt.Sprintf("Someone asked to reset the password for your account.\n\n"+
+				"Use this link within %d minutes to choose a new password:\n%s\n\n"+
+				"If this wasn't you, you can ignore this email.",
+				int(passwordResetTTL.Minutes()), appURL("/reset-password?token="+token))
+
+			if err := services.SendMail(email, "Reset your password", body); err != nil {
+				log.Printf("Failed to send password reset email to user %d: %v", userID, err)
+			}
+		}()
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func ResetPasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Token == "" || req.NewPassword == "" {
+			http.Error(w, "token and new_password are required", http.StatusBadRequest)
+			return
+		}
+
+		if err := currentPasswordPolicy().Validate(req.NewPassword); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("ResetPasswordHandler begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		var resetID, userID int
+		err = tx.QueryRow(`
+			SELECT id, user_id
+			FROM password_reset_tokens
+			WHERE token_hash = $1
+			  AND used_at IS NULL
+			  AND expires_at > NOW()
+			FOR UPDATE`,
+			hashToken(req.Token)).Scan(&resetID, &userID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+			} else {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				log.Println("ResetPasswordHandler lookup error:", err)
+			}
+			return
+		}
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE users SET password = $1 WHERE id = $2", string(hashedPassword), userID); err != nil {
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			log.Println("ResetPasswordHandler update error:", err)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = NOW() WHERE id = $1", resetID); err != nil {
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			log.Println("ResetPasswordHandler consume error:", err)
+			return
+		}
+
+		if _, err := revokeUserSessions(tx, userID, ""); err != nil {
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			log.Println("ResetPasswordHandler revoke sessions error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			log.Println("ResetPasswordHandler commit error:", err)
+			return
+		}
+		forgetSessions(userID, "")
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+	}
+}
+
+func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if !requireSelf(w, r, id) {
+			return
+		}
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			http.Error(w, "current_password and new_password are required", http.StatusBadRequest)
+			return
+		}
+
+		var hash, email string
+		err = db.QueryRow("SELECT password, email FROM users WHERE id = $1", id).Scan(&hash, &email)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("ChangePasswordHandler lookup error:", err)
+			}
+			return
+		}
+
+		// A stolen access token must not become a way to guess the password.
+		guard := services.GetLoginGuard()
+		ip := clientIP(r)
+
+		wait, err := guard.RetryAfter(email, ip)
+		if err != nil {
+			log.Println("ChangePasswordHandler attempt lookup error:", err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.CurrentPassword)); err != nil {
+			wait, recordErr := guard.RecordFailure(email, ip)
+			if recordErr != nil {
+				log.Println("ChangePasswordHandler attempt record error:", recordErr)
+			}
+			if wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+		if err := guard.RecordSuccess(email); err != nil {
+			log.Println("ChangePasswordHandler attempt reset error:", err)
+		}
+
+		if req.NewPassword == req.CurrentPassword {
+			http.Error(w, "New password must be different from the current password", http.StatusBadRequest)
+			return
+		}
+
+		if err := currentPasswordPolicy().Validate(req.NewPassword); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("ChangePasswordHandler begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("UPDATE users SET password = $1 WHERE id = $2", string(hashedPassword), id); err != nil {
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			log.Println("ChangePasswordHandler update error:", err)
+			return
+		}
+
+		// Every other device has to sign in again with the new password.
+		if _, err := revokeUserSessions(tx, id, sessionIDFromContext(r.Context())); err != nil {
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			log.Println("ChangePasswordHandler revoke sessions error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			log.Println("ChangePasswordHandler commit error:", err)
+			return
+		}
+		forgetSessions(id, "")
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully"})
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+// Personal access tokens start with this so the auth layer can tell them
+// apart from JWTs without trying to parse them.
+const personalAccessTokenPrefix = "mjp_"
+
+const maxPersonalAccessTokens = 25
+
+var errMissingScope = errors.New("token is missing the required scope")
+
+func isPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
+
+// authenticatePersonalAccessToken resolves a live token to its owner and role
+// and checks that it was granted scope.
+func authenticatePersonalAccessToken(db *sql.DB, token, scope string) (int, string, error) {
+	var tokenID, userID int
+	var role string
+	var scopes []string
+	err := db.QueryRow(`
+		SELECT pat.id, pat.user_id, u.role, pat.scopes
+		FROM personal_access_tokens pat
+		JOIN users u ON u.id = pat.user_id
+		WHERE pat.token_hash = $1
+		  AND pat.revoked_at IS NULL
+		  AND (pat.expires_at IS NULL OR pat.expires_at > NOW())`,
+		hashToken(token)).Scan(&tokenID, &userID, &role, pq.Array(&scopes))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("authenticatePersonalAccessToken lookup error:", err)
+		}
+		return 0, "", err
+	}
+
+	granted := false
+	for _, s := range scopes {
+		if s == scope {
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		return 0, "", errMissingScope
+	}
+
+	// Scripts can call us many times a second; a minute is precise enough.
+	_, err = db.Exec(`
+		UPDATE personal_access_tokens
+		SET last_used_at = NOW()
+		WHERE id = $1
+		  AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`,
+		tokenID)
+	if err != nil {
+		log.Println("authenticatePersonalAccessToken last used error:", err)
+	}
+
+	return userID, role, nil
+}
+
+func CreatePersonalAccessToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		var req struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			http.Error(w, "name is required and must be at most 100 characters", http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Scopes) == 0 {
+			http.Error(w, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range req.Scopes {
+			valid := false
+			for _, known := range models.PersonalAccessTokenScopes {
+				if scope == known {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.ExpiresInDays < 0 {
+			http.Error(w, "expires_in_days cannot be negative", http.StatusBadRequest)
+			return
+		}
+
+		var count int
+		err := db.QueryRow(`
+			SELECT COUNT(*) FROM personal_access_tokens
+			WHERE user_id = $1 AND revoked_at IS NULL`, userID).Scan(&count)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("CreatePersonalAccessToken count error:", err)
+			return
+		}
+		if count >= maxPersonalAccessTokens {
+			http.Error(w, "Too many active tokens, revoke one first", http.StatusBadRequest)
+			return
+		}
+
+		secret, err := randomToken(32)
+		if err != nil {
+			http.Error(w, "Could not create token", http.StatusInternalServerError)
+			return
+		}
+		token := personalAccessTokenPrefix + secret
+
+		var expiresAt *time.Time
+		if req.ExpiresInDays > 0 {
+			t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+			expiresAt = &t
+		}
+
+		pat := models.PersonalAccessToken{
+			Name:   req.Name,
+			Prefix: token[:len(personalAccessTokenPrefix)+6],
+			Scopes: req.Scopes,
+			Token:  token,
+		}
+		err = db.QueryRow(`
+			INSERT INTO personal_access_tokens (user_id, name, token_hash, prefix, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, expires_at, created_at`,
+			userID, pat.Name, hashToken(token), pat.Prefix, pq.Array(pat.Scopes), expiresAt,
+		).Scan(&pat.ID, &pat.ExpiresAt, &pat.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			log.Println("CreatePersonalAccessToken insert error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pat)
+	}
+}
+
+func GetPersonalAccessTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		rows, err := db.Query(`
+			SELECT id, name, prefix, scopes, last_used_at, expires_at, created_at
+			FROM personal_access_tokens
+			WHERE user_id = $1 AND revoked_at IS NULL
+			ORDER BY created_at DESC`, userID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetPersonalAccessTokens error:", err)
+			return
+		}
+		defer rows.Close()
+
+		tokens := []models.PersonalAccessToken{}
+		for rows.Next() {
+			var t models.PersonalAccessToken
+			if err := rows.Scan(
+				&t.ID,
+				&t.Name,
+				&t.Prefix,
+				pq.Array(&t.Scopes),
+				&t.LastUsedAt,
+				&t.ExpiresAt,
+				&t.CreatedAt,
+			); err != nil {
+				http.Error(w, "Error scanning tokens", http.StatusInternalServerError)
+				log.Println("GetPersonalAccessTokens scan error:", err)
+				return
+			}
+			tokens = append(tokens, t)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating tokens", http.StatusInternalServerError)
+			log.Println("GetPersonalAccessTokens rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+func RevokePersonalAccessToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+		id := mux.Vars(r)["id"]
+
+		result, err := db.Exec(`
+			UPDATE personal_access_tokens
+			SET revoked_at = NOW()
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+			id, userID)
+		if err != nil {
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			log.Println("RevokePersonalAccessToken error:", err)
+			return
+		}
+
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked successfully"})
+	}
+}
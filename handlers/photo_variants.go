@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"image"
+	"log"
+	"strings"
+	"time"
+
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const (
+	thumbnailSize  = 320
+	mediumSize     = 1080
+	variantQuality = 85
+
+	// maxVariantAttempts stops the worker from retrying a photo that can
+	// never be processed, such as one whose blob went missing.
+	maxVariantAttempts = 3
+)
+
+// photoVariantsWake nudges the worker right after an upload so variants are
+// usually ready before the post is created. The ticker still picks up
+// anything missed, for example after a restart.
+var photoVariantsWake = make(chan struct{}, 1)
+
+func queuePhotoVariants() {
+	select {
+	case photoVariantsWake <- struct{}{}:
+	default:
+	}
+}
+
+// variantKey derives the key of a resized copy from the original, e.g.
+// photos/12/ab.png -> photos/12/ab_thumb.jpg.
+func variantKey(key, suffix string) string {
+	if i := strings.LastIndex(key, "."); i > strings.LastIndex(key, "/") {
+		key = key[:i]
+	}
+	return key + "_" + suffix + ".jpg"
+}
+
+// StartPhotoVariantWorker generates thumbnail and medium variants plus a
+// blurhash for new uploads in the background, checking every interval.
+func StartPhotoVariantWorker(db *sql.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			processPendingPhotoVariants(db)
+
+			select {
+			case <-ticker.C:
+			case <-photoVariantsWake:
+			}
+		}
+	}()
+}
+
+// processPendingPhotoVariants works through uploads without variants one at a
+// time. A claim that is not finished within five minutes is taken over again,
+// so a crash mid-way does not leave a photo stuck.
+func processPendingPhotoVariants(db *sql.DB) {
+	for {
+		var id int
+		var key string
+		err := db.QueryRow(`
+			UPDATE uploads
+			SET variant_claimed_at = NOW(), variant_attempts = variant_attempts + 1
+			WHERE id = (
+				SELECT id FROM uploads
+				WHERE NOT variants_ready
+				  AND variant_attempts < $1
+				  AND (variant_claimed_at IS NULL OR variant_claimed_at < NOW() - INTERVAL '5 minutes')
+				ORDER BY id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, storage_key`,
+			maxVariantAttempts,
+		).Scan(&id, &key)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Error claiming photo for variants: %v", err)
+			return
+		}
+
+		if err := generatePhotoVariants(db, id, key); err != nil {
+			log.Printf("Error generating variants for %s: %v", key, err)
+			// Release the claim so the next pass can retry.
+			if _, err := db.Exec(`UPDATE uploads SET variant_claimed_at = NULL WHERE id = $1`, id); err != nil {
+				log.Printf("Error releasing variant claim for %s: %v", key, err)
+			}
+		}
+	}
+}
+
+func generatePhotoVariants(db *sql.DB, id int, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	body, err := services.Blobs().Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	img, err := services.DecodeImage(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	medium := services.ResizeToFit(img, mediumSize)
+	thumbnail := services.ResizeToFit(medium, thumbnailSize)
+	blurhash := services.Blurhash(services.ResizeToFit(thumbnail, 32), 4, 3)
+
+	thumbnailKey := variantKey(key, "thumb")
+	mediumKey := variantKey(key, "medium")
+	for _, v := range []struct {
+		key string
+		img *image.RGBA
+	}{
+		{thumbnailKey, thumbnail},
+		{mediumKey, medium},
+	} {
+		data, err := services.EncodeJPEG(v.img, variantQuality)
+		if err != nil {
+			return err
+		}
+		if err := services.Blobs().Put(ctx, v.key, bytes.NewReader(data), int64(len(data)), "image/jpeg"); err != nil {
+			return err
+		}
+	}
+
+	result, err := db.Exec(`
+		UPDATE uploads
+		SET thumbnail_key = $1, medium_key = $2, blurhash = $3, variants_ready = TRUE
+		WHERE id = $4`,
+		thumbnailKey, mediumKey, blurhash, id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		// The photo was deleted while we worked on it, and whoever deleted
+		// it may have missed the variants that were not there yet.
+		for _, variant := range []string{thumbnailKey, mediumKey} {
+			if err := services.Blobs().Delete(ctx, variant); err != nil {
+				log.Printf("Failed to delete photo variant %s: %v", variant, err)
+			}
+		}
+		return nil
+	}
+
+	// The post may already exist; CreatePost copies the variants itself when
+	// it is created after this point.
+	_, err = db.Exec(`
+		UPDATE posts
+		SET thumbnail_path = $1, medium_path = $2, blurhash = $3
+		WHERE photo_path = $4`,
+		thumbnailKey, mediumKey, blurhash, key)
+	return err
+}
@@ -6,14 +6,80 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"masterboxer.com/project-micro-journal/models"
 	"masterboxer.com/project-micro-journal/services"
 )
 
+// postColumns are the columns a post is returned with, for queries that
+// alias posts as p. Scan them with postDest or feedPostDest.
+const postColumns = `p.id, p.user_id, p.template_id, p.text, COALESCE(p.photo_path, ''),
+	COALESCE(p.thumbnail_path, ''), COALESCE(p.medium_path, ''), COALESCE(p.blurhash, ''),
+	p.created_at, p.edited_at, p.visibility`
+
+func postDest(p *models.Post) []interface{} {
+	return []interface{}{
+		&p.ID,
+		&p.UserID,
+		&p.TemplateID,
+		&p.Text,
+		&p.PhotoPath,
+		&p.ThumbnailPath,
+		&p.MediumPath,
+		&p.Blurhash,
+		&p.CreatedAt,
+		&p.EditedAt,
+		&p.Visibility,
+	}
+}
+
+// feedPostDest also takes the author's username and display name, which
+// feed queries select after postColumns.
+func feedPostDest(p *models.PostWithUser) []interface{} {
+	return []interface{}{
+		&p.ID,
+		&p.UserID,
+		&p.TemplateID,
+		&p.Text,
+		&p.PhotoPath,
+		&p.ThumbnailPath,
+		&p.MediumPath,
+		&p.Blurhash,
+		&p.CreatedAt,
+		&p.EditedAt,
+		&p.Visibility,
+		&p.Username,
+		&p.DisplayName,
+	}
+}
+
+// fillPhotoURLs signs the links to a post's photo and its resized copies
+// and sets Edited.
+func fillPhotoURLs(p *models.Post) {
+	if p.PhotoPath != nil && *p.PhotoPath == "" {
+		p.PhotoPath = nil
+	}
+	if p.PhotoPath != nil {
+		p.PhotoURL = photoURL(*p.PhotoPath)
+	}
+	p.ThumbnailURL = photoURL(p.ThumbnailPath)
+	p.MediumURL = photoURL(p.MediumPath)
+	p.Edited = p.EditedAt != nil
+}
+
+func fillFeedPhotoURLs(p *models.PostWithUser) {
+	p.PhotoURL = photoURL(p.PhotoPath)
+	p.ThumbnailURL = photoURL(p.ThumbnailPath)
+	p.MediumURL = photoURL(p.MediumPath)
+	p.Edited = p.EditedAt != nil
+}
+
 func GetPostsByUser(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -28,15 +94,23 @@ func GetPostsByUser(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Invalid userId", http.StatusBadRequest)
 			return
 		}
+		callerID, _ := UserIDFromContext(r.Context())
 
+		// Strangers see public posts, buddies also see buddies-only posts
+		// (when they are in one of the post's circles, if it has any) and the
+		// author sees everything.
 		rows, err := db.Query(`
-			SELECT id, user_id, template_id, text, 
-			       COALESCE(photo_path, '') as photo_path, 
-			       created_at
-			FROM posts
-			WHERE user_id = $1
-			ORDER BY created_at DESC`,
-			userID)
+			SELECT `+postColumns+`
+			FROM posts p
+			WHERE p.user_id = $1
+			  AND (p.user_id = $2
+			       OR p.visibility = 'public'
+			       OR (p.visibility = 'buddies' AND EXISTS(
+			           SELECT 1 FROM buddies b WHERE b.user_id = $2 AND b.buddy_id = $1)
+			           AND `+circleAllowsViewer("p.id", "$2")+`))
+			  AND NOT EXISTS(SELECT 1 FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2)
+			ORDER BY p.created_at DESC`,
+			userID, callerID)
 		if err != nil {
 			http.Error(w, "Database query failed", http.StatusInternalServerError)
 			log.Printf("GetPostsByUser error: %v", err)
@@ -47,18 +121,12 @@ func GetPostsByUser(db *sql.DB) http.HandlerFunc {
 		var posts []models.Post
 		for rows.Next() {
 			var p models.Post
-			if err := rows.Scan(
-				&p.ID,
-				&p.UserID,
-				&p.TemplateID,
-				&p.Text,
-				&p.PhotoPath,
-				&p.CreatedAt,
-			); err != nil {
+			if err := rows.Scan(postDest(&p)...); err != nil {
 				http.Error(w, "Error scanning posts", http.StatusInternalServerError)
 				log.Printf("GetPostsByUser scan error: %v", err)
 				return
 			}
+			fillPhotoURLs(&p)
 			posts = append(posts, p)
 		}
 
@@ -68,6 +136,14 @@ func GetPostsByUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if callerID == userID {
+			if err := attachCircleIDs(db, posts); err != nil {
+				http.Error(w, "Failed to load circles", http.StatusInternalServerError)
+				log.Printf("GetPostsByUser circles error: %v", err)
+				return
+			}
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(posts)
 	}
@@ -82,7 +158,9 @@ func CreatePost(db *sql.DB) http.HandlerFunc {
 		}
 
 		if p.UserID == 0 {
-			http.Error(w, "user_id is required", http.StatusBadRequest)
+			p.UserID, _ = UserIDFromContext(r.Context())
+		}
+		if !requireSelf(w, r, p.UserID) || !requireVerifiedEmail(db, w, r) {
 			return
 		}
 		if p.TemplateID == 0 {
@@ -97,38 +175,93 @@ func CreatePost(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "text must be at most 280 characters", http.StatusBadRequest)
 			return
 		}
+		if p.Visibility == "" {
+			err := db.QueryRow(`SELECT default_post_visibility FROM users WHERE id = $1`, p.UserID).
+				Scan(&p.Visibility)
+			if err != nil {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("CreatePost default visibility error:", err)
+				return
+			}
+		}
+		if !validPostVisibility(p.Visibility) {
+			http.Error(w, "visibility must be private, buddies or public", http.StatusBadRequest)
+			return
+		}
+		if len(p.CircleIDs) > 0 {
+			if p.Visibility != models.VisibilityBuddies {
+				http.Error(w, errCirclesNotBuddy.Error(), http.StatusBadRequest)
+				return
+			}
+			circleIDs, err := checkPostCircles(db, p.UserID, p.CircleIDs)
+			if err != nil {
+				if err == errCircleNotFound {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println("CreatePost circle check error:", err)
+				}
+				return
+			}
+			p.CircleIDs = circleIDs
+		}
+		if p.PhotoPath != nil && *p.PhotoPath == "" {
+			p.PhotoPath = nil
+		}
 
-		now := time.Now().UTC()
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-		endOfDay := startOfDay.Add(24 * time.Hour)
-
-		var postCount int
-		err := db.QueryRow(`
-			SELECT COUNT(*) 
-			FROM posts 
-			WHERE user_id = $1 
-			  AND created_at >= $2 
-			  AND created_at < $3`,
-			p.UserID, startOfDay, endOfDay).Scan(&postCount)
+		today, err := userToday(db, p.UserID)
 		if err != nil {
 			http.Error(w, "Failed to check daily limit", http.StatusInternalServerError)
 			log.Println("CreatePost daily limit check error:", err)
 			return
 		}
 
-		if postCount > 0 {
-			http.Error(w, "Daily post limit reached (1 post per day)", http.StatusForbidden)
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
 
-		err = db.QueryRow(`
-			INSERT INTO posts (user_id, template_id, text, photo_path, created_at)
-			VALUES ($1, $2, $3, $4, NOW())
-			RETURNING id, user_id, template_id, text, photo_path, created_at`,
+		if p.PhotoPath != nil {
+			if err := checkPhotoUpload(tx, p.UserID, 0, *p.PhotoPath); err != nil {
+				if err == errPhotoNotUploaded || err == errPhotoInUse {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println("CreatePost photo check error:", err)
+				}
+				return
+			}
+		}
+
+		circleIDs := make([]int64, len(p.CircleIDs))
+		for i, id := range p.CircleIDs {
+			circleIDs[i] = int64(id)
+		}
+
+		// The unique index on (user_id, local_date) enforces the daily limit,
+		// so concurrent requests cannot both get through. Circles are written
+		// in the same statement so the post is never briefly shared with
+		// every buddy. Only a few posts from before migration 000018 have a
+		// NULL local_date; they never count as today's post.
+		err = tx.QueryRow(`
+			WITH p AS (
+				INSERT INTO posts (user_id, template_id, text, photo_path, visibility, local_date, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, NOW())
+				RETURNING id, user_id, template_id, text, photo_path, created_at
+			), c AS (
+				INSERT INTO post_circles (post_id, circle_id)
+				SELECT p.id, UNNEST($7::int[]) FROM p
+			)
+			SELECT id, user_id, template_id, text, photo_path, created_at FROM p`,
 			p.UserID,
 			p.TemplateID,
 			p.Text,
 			p.PhotoPath,
+			p.Visibility,
+			today,
+			pq.Array(circleIDs),
 		).Scan(
 			&p.ID,
 			&p.UserID,
@@ -138,12 +271,53 @@ func CreatePost(db *sql.DB) http.HandlerFunc {
 			&p.CreatedAt,
 		)
 		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "Daily post limit reached (1 post per day)", http.StatusForbidden)
+				return
+			}
 			http.Error(w, "Failed to create post", http.StatusInternalServerError)
 			log.Println("CreatePost error:", err)
 			return
 		}
 
-		go notifyBuddiesOfNewPost(db, p.UserID, p.Text)
+		if p.PhotoPath != nil {
+			if err := attachPhotoUpload(tx, p.UserID, p.ID, *p.PhotoPath); err != nil {
+				if err == errPhotoInUse {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Failed to create post", http.StatusInternalServerError)
+					log.Println("CreatePost attach photo error:", err)
+				}
+				return
+			}
+
+			// Variants finished before the post existed are copied over here;
+			// later ones are written to the post by the worker.
+			err = tx.QueryRow(`
+				UPDATE posts p
+				SET thumbnail_path = u.thumbnail_key, medium_path = u.medium_key, blurhash = u.blurhash
+				FROM uploads u
+				WHERE p.id = $1 AND u.storage_key = p.photo_path AND u.variants_ready
+				RETURNING p.thumbnail_path, p.medium_path, p.blurhash`,
+				p.ID,
+			).Scan(&p.ThumbnailPath, &p.MediumPath, &p.Blurhash)
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, "Failed to create post", http.StatusInternalServerError)
+				log.Println("CreatePost copy photo variants error:", err)
+				return
+			}
+		}
+		fillPhotoURLs(&p)
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to create post", http.StatusInternalServerError)
+			log.Println("CreatePost commit error:", err)
+			return
+		}
+
+		if p.Visibility != models.VisibilityPrivate {
+			go notifyBuddiesOfNewPost(db, p.UserID, p.ID, p.Text)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -151,48 +325,91 @@ func CreatePost(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func notifyBuddiesOfNewPost(db *sql.DB, userID int, postText string) {
-	var displayName string
-	err := db.QueryRow(`SELECT display_name FROM users WHERE id = $1`, userID).Scan(&displayName)
+// userToday returns the current date in the user's time zone, formatted for a
+// DATE column. Posts are limited to one per local date.
+func userToday(db *sql.DB, userID int) (string, error) {
+	var timezone string
+	if err := db.QueryRow(`SELECT timezone FROM users WHERE id = $1`, userID).Scan(&timezone); err != nil {
+		return "", err
+	}
+
+	loc, err := time.LoadLocation(timezone)
 	if err != nil {
-		log.Printf("Error fetching user display name for notifications: %v", err)
-		displayName = "A friend"
+		log.Printf("User %d has invalid timezone %q, using UTC", userID, timezone)
+		loc = time.UTC
 	}
+	return time.Now().In(loc).Format("2006-01-02"), nil
+}
+
+// notificationPreview shortens text to fit a push notification, cutting on
+// a character boundary so multi-byte text stays valid UTF-8.
+func notificationPreview(text string) string {
+	runes := []rune(text)
+	if len(runes) <= 100 {
+		return text
+	}
+	return string(runes[:97]) + "..."
+}
 
+// postAudience returns the users to notify about postID: everyone who sees
+// authorID's posts, is in one of the post's circles when it has any, and has
+// not muted the author.
+func postAudience(db *sql.DB, authorID, postID int) ([]int, error) {
 	rows, err := db.Query(`
-		SELECT DISTINCT ft.token
+		SELECT b.user_id
 		FROM buddies b
-		JOIN fcm_tokens ft ON b.buddy_id = ft.user_id
-		WHERE b.user_id = $1 
-		  AND ft.token IS NOT NULL 
-		  AND ft.token != ''`,
-		userID)
+		WHERE b.buddy_id = $1
+		  AND NOT EXISTS(SELECT 1 FROM user_mutes m WHERE m.muter_id = b.user_id AND m.muted_id = $1)
+		  AND `+circleAllowsViewer("$2", "b.user_id"),
+		authorID, postID)
 	if err != nil {
-		log.Printf("Error fetching buddy FCM tokens: %v", err)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	var tokens []string
+	var ids []int
 	for rows.Next() {
-		var token string
-		if err := rows.Scan(&token); err != nil {
-			log.Printf("Error scanning FCM token: %v", err)
-			continue
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
 		}
-		tokens = append(tokens, token)
+		ids = append(ids, id)
 	}
+	return ids, rows.Err()
+}
 
+// notifyBuddiesOfNewPost tells everyone who sees the author's posts about a
+// new one, only those in its circles when it has any. Buddies who muted the
+// author are left out.
+func notifyBuddiesOfNewPost(db *sql.DB, userID, postID int, postText string) {
+	var displayName string
+	err := db.QueryRow(`SELECT display_name FROM users WHERE id = $1`, userID).Scan(&displayName)
+	if err != nil {
+		log.Printf("Error fetching user display name for notifications: %v", err)
+		displayName = "A friend"
+	}
+
+	recipients, err := postAudience(db, userID, postID)
+	if err != nil {
+		log.Printf("Error fetching buddies to notify: %v", err)
+		return
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	tokens, err := userFCMTokens(db, recipients...)
+	if err != nil {
+		log.Printf("Error fetching buddy FCM tokens: %v", err)
+		return
+	}
 	if len(tokens) == 0 {
 		log.Printf("No FCM tokens found for user %d's buddies", userID)
 		return
 	}
 
 	title := fmt.Sprintf("%s posted today!", displayName)
-	body := postText
-	if len(body) > 100 {
-		body = body[:97] + "..."
-	}
+	body := notificationPreview(postText)
 
 	data := map[string]string{
 		"type":    "new_post",
@@ -209,26 +426,425 @@ func notifyBuddiesOfNewPost(db *sql.DB, userID int, postText string) {
 		userID, successCount, failureCount)
 }
 
+var (
+	postEditWindow     time.Duration
+	postEditWindowOnce sync.Once
+)
+
+// currentPostEditWindow reads POST_EDIT_WINDOW_MINUTES (default 60) on first
+// use.
+func currentPostEditWindow() time.Duration {
+	postEditWindowOnce.Do(func() {
+		postEditWindow = time.Hour
+		if n, err := strconv.Atoi(os.Getenv("POST_EDIT_WINDOW_MINUTES")); err == nil && n >= 0 {
+			postEditWindow = time.Duration(n) * time.Minute
+		}
+	})
+	return postEditWindow
+}
+
+// UpdatePost lets the author change a post's text, template or photo for a
+// while after posting. The previous version is kept in post_revisions.
+// Fields left out of the body are not changed; an empty photoPath removes
+// the photo. Visibility and circle_ids can be changed at any time and are not
+// revisions; circles are dropped when the post stops being buddies-only.
+func UpdatePost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid post id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			TemplateID *int    `json:"template_id"`
+			Text       *string `json:"text"`
+			PhotoPath  *string `json:"photoPath"`
+			Visibility *string `json:"visibility"`
+			CircleIDs  *[]int  `json:"circle_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.TemplateID == nil && req.Text == nil && req.PhotoPath == nil && req.Visibility == nil &&
+			req.CircleIDs == nil {
+			http.Error(w, "Nothing to update", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var ownerID, templateID int
+		var text, photoPath, visibility string
+		var versionAt time.Time
+		var editable bool
+		err = tx.QueryRow(`
+			SELECT user_id, template_id, text, COALESCE(photo_path, ''), visibility,
+			       COALESCE(edited_at, created_at),
+			       created_at > NOW() - $2 * INTERVAL '1 second'
+			FROM posts
+			WHERE id = $1
+			FOR UPDATE`,
+			postID, int64(currentPostEditWindow().Seconds()),
+		).Scan(&ownerID, &templateID, &text, &photoPath, &visibility, &versionAt, &editable)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Post not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("UpdatePost select error:", err)
+			}
+			return
+		}
+		if !requireSelf(w, r, ownerID) || !requireVerifiedEmail(db, w, r) {
+			return
+		}
+		newTemplateID, newText, newPhotoPath, newVisibility := templateID, text, photoPath, visibility
+		if req.TemplateID != nil {
+			if *req.TemplateID == 0 {
+				http.Error(w, "template_id is required", http.StatusBadRequest)
+				return
+			}
+			newTemplateID = *req.TemplateID
+		}
+		if req.Text != nil {
+			if *req.Text == "" {
+				http.Error(w, "text is required", http.StatusBadRequest)
+				return
+			}
+			if len(*req.Text) > 280 {
+				http.Error(w, "text must be at most 280 characters", http.StatusBadRequest)
+				return
+			}
+			newText = *req.Text
+		}
+		if req.PhotoPath != nil {
+			newPhotoPath = *req.PhotoPath
+		}
+		if req.Visibility != nil {
+			if !validPostVisibility(*req.Visibility) {
+				http.Error(w, "visibility must be private, buddies or public", http.StatusBadRequest)
+				return
+			}
+			newVisibility = *req.Visibility
+		}
+		var circleIDs []int64
+		if req.CircleIDs != nil && len(*req.CircleIDs) > 0 {
+			if newVisibility != models.VisibilityBuddies {
+				http.Error(w, errCirclesNotBuddy.Error(), http.StatusBadRequest)
+				return
+			}
+			ids, err := checkPostCircles(db, ownerID, *req.CircleIDs)
+			if err != nil {
+				if err == errCircleNotFound {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println("UpdatePost circle check error:", err)
+				}
+				return
+			}
+			for _, id := range ids {
+				circleIDs = append(circleIDs, int64(id))
+			}
+		}
+
+		photoChanged := newPhotoPath != photoPath
+		contentChanged := newTemplateID != templateID || newText != text || photoChanged
+		if contentChanged && !editable {
+			http.Error(w, fmt.Sprintf("Posts can only be edited within %s of posting", currentPostEditWindow()), http.StatusForbidden)
+			return
+		}
+		if photoChanged && newPhotoPath != "" {
+			if err := checkPhotoUpload(tx, ownerID, postID, newPhotoPath); err != nil {
+				if err == errPhotoNotUploaded || err == errPhotoInUse {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println("UpdatePost photo check error:", err)
+				}
+				return
+			}
+		}
+
+		if contentChanged {
+			_, err = tx.Exec(`
+				INSERT INTO post_revisions (post_id, template_id, text, photo_path, created_at)
+				VALUES ($1, $2, $3, NULLIF($4, ''), $5)`,
+				postID, templateID, text, photoPath, versionAt)
+			if err != nil {
+				http.Error(w, "Failed to update post", http.StatusInternalServerError)
+				log.Println("UpdatePost revision error:", err)
+				return
+			}
+
+			_, err = tx.Exec(`
+				UPDATE posts
+				SET template_id = $1, text = $2, photo_path = NULLIF($3, ''), edited_at = NOW()
+				WHERE id = $4`,
+				newTemplateID, newText, newPhotoPath, postID)
+			if err != nil {
+				http.Error(w, "Failed to update post", http.StatusInternalServerError)
+				log.Println("UpdatePost error:", err)
+				return
+			}
+		}
+
+		if newVisibility != visibility {
+			_, err = tx.Exec(`UPDATE posts SET visibility = $1 WHERE id = $2`, newVisibility, postID)
+			if err != nil {
+				http.Error(w, "Failed to update post", http.StatusInternalServerError)
+				log.Println("UpdatePost visibility error:", err)
+				return
+			}
+		}
+
+		if req.CircleIDs != nil || newVisibility != models.VisibilityBuddies {
+			_, err = tx.Exec(`DELETE FROM post_circles WHERE post_id = $1`, postID)
+			if err == nil && len(circleIDs) > 0 {
+				_, err = tx.Exec(`
+					INSERT INTO post_circles (post_id, circle_id)
+					SELECT $1, UNNEST($2::int[])`,
+					postID, pq.Array(circleIDs))
+			}
+			if err != nil {
+				http.Error(w, "Failed to update post", http.StatusInternalServerError)
+				log.Println("UpdatePost circles error:", err)
+				return
+			}
+		}
+
+		if photoChanged {
+			// The old photo stays attached so its revision can still show it.
+			_, err = tx.Exec(`
+				UPDATE posts SET thumbnail_path = NULL, medium_path = NULL, blurhash = NULL
+				WHERE id = $1`, postID)
+			if err == nil && newPhotoPath != "" {
+				err = attachPhotoUpload(tx, ownerID, postID, newPhotoPath)
+				if err == errPhotoInUse {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err == nil && newPhotoPath != "" {
+				_, err = tx.Exec(`
+					UPDATE posts p
+					SET thumbnail_path = u.thumbnail_key, medium_path = u.medium_key, blurhash = u.blurhash
+					FROM uploads u
+					WHERE p.id = $1 AND u.storage_key = p.photo_path AND u.variants_ready`,
+					postID)
+			}
+			if err != nil {
+				http.Error(w, "Failed to update post", http.StatusInternalServerError)
+				log.Println("UpdatePost photo error:", err)
+				return
+			}
+		}
+
+		var p models.Post
+		err = tx.QueryRow(`
+			SELECT `+postColumns+`
+			FROM posts p
+			WHERE p.id = $1`,
+			postID,
+		).Scan(postDest(&p)...)
+		if err != nil {
+			http.Error(w, "Failed to update post", http.StatusInternalServerError)
+			log.Println("UpdatePost reload error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to update post", http.StatusInternalServerError)
+			log.Println("UpdatePost commit error:", err)
+			return
+		}
+
+		p.CircleIDs, err = postCircleIDs(db, postID)
+		if err != nil {
+			log.Println("UpdatePost circles reload error:", err)
+		}
+
+		fillPhotoURLs(&p)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// GetPostRevisions lists the earlier versions of a post, newest first. Only
+// the author can see them.
+func GetPostRevisions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var ownerID int
+		err := db.QueryRow(`SELECT user_id FROM posts WHERE id = $1`, id).Scan(&ownerID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Post not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("GetPostRevisions error:", err)
+			}
+			return
+		}
+		if !requireSelf(w, r, ownerID) {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, post_id, template_id, text, COALESCE(photo_path, ''), created_at
+			FROM post_revisions
+			WHERE post_id = $1
+			ORDER BY created_at DESC, id DESC`,
+			id)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetPostRevisions error:", err)
+			return
+		}
+		defer rows.Close()
+
+		revisions := []models.PostRevision{}
+		for rows.Next() {
+			var rev models.PostRevision
+			if err := rows.Scan(&rev.ID, &rev.PostID, &rev.TemplateID, &rev.Text, &rev.PhotoPath, &rev.CreatedAt); err != nil {
+				http.Error(w, "Error scanning revisions", http.StatusInternalServerError)
+				log.Println("GetPostRevisions scan error:", err)
+				return
+			}
+			rev.PhotoURL = photoURL(rev.PhotoPath)
+			revisions = append(revisions, rev)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating revisions", http.StatusInternalServerError)
+			log.Println("GetPostRevisions rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(revisions)
+	}
+}
+
+// postAccess reports who wrote postID and whether viewerID may see it among
+// buddies: the author always can, and anyone who has the author as a buddy
+// can unless the post is private or limited to circles they are not in.
+// Comments and reactions use this, so public posts do not open them up to
+// strangers.
+func postAccess(db *sql.DB, postID, viewerID int) (ownerID int, visible bool, err error) {
+	err = db.QueryRow(`
+		SELECT p.user_id,
+		       p.user_id = $2 OR (p.visibility <> 'private' AND
+		           EXISTS(SELECT 1 FROM buddies b WHERE b.user_id = $2 AND b.buddy_id = p.user_id) AND
+		           `+circleAllowsViewer("p.id", "$2")+`)
+		FROM posts p
+		WHERE p.id = $1`,
+		postID, viewerID,
+	).Scan(&ownerID, &visible)
+	return ownerID, visible, err
+}
+
+// requirePostAccess writes a 404 or 403 and returns false when viewerID may
+// not see postID.
+func requirePostAccess(db *sql.DB, w http.ResponseWriter, postID, viewerID int) (int, bool) {
+	ownerID, visible, err := postAccess(db, postID, viewerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Post not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("postAccess error:", err)
+		}
+		return 0, false
+	}
+	if !visible {
+		http.Error(w, "You can only see your buddies' posts", http.StatusForbidden)
+		return 0, false
+	}
+	return ownerID, true
+}
+
+func validPostVisibility(visibility string) bool {
+	switch visibility {
+	case models.VisibilityPrivate, models.VisibilityBuddies, models.VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+// postPhotoKeys returns every photo attached to a post, including ones only
+// referenced by earlier revisions.
+func postPhotoKeys(db *sql.DB, postID string) ([]string, error) {
+	rows, err := db.Query(`SELECT storage_key FROM uploads WHERE post_id = $1`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// deletePostWithPhotos deletes a post and then, in the background, every
+// photo it used. Earlier revisions may have used other photos; they are all
+// attached to the post. It reports whether the post existed.
+func deletePostWithPhotos(db *sql.DB, postID string) (bool, error) {
+	photos, err := postPhotoKeys(db, postID)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(`DELETE FROM posts WHERE id = $1`, postID)
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return false, nil
+	}
+
+	go func() {
+		for _, key := range photos {
+			deletePhoto(db, key)
+		}
+	}()
+	return true, nil
+}
+
 func DeletePost(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		var exists bool
-		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM posts WHERE id = $1)`, id).
-			Scan(&exists)
+		var ownerID int
+		err := db.QueryRow(`SELECT user_id FROM posts WHERE id = $1`, id).Scan(&ownerID)
 		if err != nil {
-			http.Error(w, "Database query failed", http.StatusInternalServerError)
-			log.Println(err)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Post not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println(err)
+			}
 			return
 		}
-		if !exists {
-			http.Error(w, "Post not found", http.StatusNotFound)
+		if !requireSelf(w, r, ownerID) {
 			return
 		}
 
-		_, err = db.Exec(`DELETE FROM posts WHERE id = $1`, id)
-		if err != nil {
+		if _, err := deletePostWithPhotos(db, id); err != nil {
 			http.Error(w, "Failed to delete post", http.StatusInternalServerError)
 			log.Println(err)
 			return
@@ -256,38 +872,39 @@ func GetTodayPostForUser(db *sql.DB) http.HandlerFunc {
 		} else {
 			uidStr := r.URL.Query().Get("user_id")
 			if uidStr == "" {
-				http.Error(w, "user_id is required", http.StatusBadRequest)
-				return
-			}
-			userID, err = strconv.Atoi(uidStr)
-			if err != nil {
-				http.Error(w, "Invalid user_id", http.StatusBadRequest)
-				return
+				userID, _ = UserIDFromContext(r.Context())
+			} else {
+				userID, err = strconv.Atoi(uidStr)
+				if err != nil {
+					http.Error(w, "Invalid user_id", http.StatusBadRequest)
+					return
+				}
 			}
 		}
 
-		now := time.Now()
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		endOfDay := startOfDay.Add(24 * time.Hour)
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
+		today, err := userToday(db, userID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println(err)
+			}
+			return
+		}
 
 		var p models.Post
 		err = db.QueryRow(`
-			SELECT id, user_id, template_id, text, photo_path, created_at
-			FROM posts
-			WHERE user_id = $1
-			  AND created_at >= $2
-			  AND created_at < $3
-			ORDER BY created_at DESC
-			LIMIT 1`,
-			userID, startOfDay, endOfDay,
-		).Scan(
-			&p.ID,
-			&p.UserID,
-			&p.TemplateID,
-			&p.Text,
-			&p.PhotoPath,
-			&p.CreatedAt,
-		)
+			SELECT `+postColumns+`
+			FROM posts p
+			WHERE p.user_id = $1
+			  AND p.local_date = $2`,
+			userID, today,
+		).Scan(postDest(&p)...)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -299,6 +916,13 @@ func GetTodayPostForUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		fillPhotoURLs(&p)
+
+		p.CircleIDs, err = postCircleIDs(db, p.ID)
+		if err != nil {
+			log.Println("GetTodayPostForUser circles error:", err)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(p)
 	}
@@ -319,13 +943,14 @@ func GetBuddyPosts(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
 		thirtysixHoursAgo := time.Now().Add(-36 * time.Hour)
 
 		rows, err := db.Query(`
-            SELECT p.id, p.user_id, p.template_id, p.text, 
-                   COALESCE(p.photo_path, '') as photo_path, 
-                   p.created_at, 
-                   u.username, u.display_name
+            SELECT `+postColumns+`, u.username, u.display_name
             FROM posts p
             JOIN users u ON p.user_id = u.id
             WHERE p.user_id = $1
@@ -342,20 +967,12 @@ func GetBuddyPosts(db *sql.DB) http.HandlerFunc {
 		var userPosts []models.PostWithUser
 		for rows.Next() {
 			var p models.PostWithUser
-			if err := rows.Scan(
-				&p.ID,
-				&p.UserID,
-				&p.TemplateID,
-				&p.Text,
-				&p.PhotoPath,
-				&p.CreatedAt,
-				&p.Username,
-				&p.DisplayName,
-			); err != nil {
+			if err := rows.Scan(feedPostDest(&p)...); err != nil {
 				http.Error(w, "Error scanning user posts", http.StatusInternalServerError)
 				log.Println("GetBuddyPosts user scan error:", err)
 				return
 			}
+			fillFeedPhotoURLs(&p)
 			userPosts = append(userPosts, p)
 		}
 		if err := rows.Err(); err != nil {
@@ -365,20 +982,15 @@ func GetBuddyPosts(db *sql.DB) http.HandlerFunc {
 		}
 
 		rows, err = db.Query(`
-            SELECT
-                p.id,
-                p.user_id,
-                p.template_id,
-                p.text,
-                COALESCE(p.photo_path, '') as photo_path,
-                p.created_at,
-                u.username,
-                u.display_name
+            SELECT `+postColumns+`, u.username, u.display_name
             FROM posts p
             JOIN buddies b ON p.user_id = b.buddy_id
             JOIN users u ON p.user_id = u.id
             WHERE b.user_id = $1
               AND p.user_id != $2
+              AND p.visibility IN ('buddies', 'public')
+              AND `+circleAllowsViewer("p.id", "$1")+`
+              AND NOT EXISTS(SELECT 1 FROM user_mutes m WHERE m.muter_id = $1 AND m.muted_id = p.user_id)
               AND p.created_at >= $3
             ORDER BY p.created_at DESC
             LIMIT 49`,
@@ -393,20 +1005,12 @@ func GetBuddyPosts(db *sql.DB) http.HandlerFunc {
 		var buddyPosts []models.PostWithUser
 		for rows.Next() {
 			var p models.PostWithUser
-			if err := rows.Scan(
-				&p.ID,
-				&p.UserID,
-				&p.TemplateID,
-				&p.Text,
-				&p.PhotoPath,
-				&p.CreatedAt,
-				&p.Username,
-				&p.DisplayName,
-			); err != nil {
+			if err := rows.Scan(feedPostDest(&p)...); err != nil {
 				http.Error(w, "Error scanning buddy posts", http.StatusInternalServerError)
 				log.Println("GetBuddyPosts buddy scan error:", err)
 				return
 			}
+			fillFeedPhotoURLs(&p)
 			buddyPosts = append(buddyPosts, p)
 		}
 		if err := rows.Err(); err != nil {
@@ -419,6 +1023,17 @@ func GetBuddyPosts(db *sql.DB) http.HandlerFunc {
 		feed = append(feed, userPosts...)
 		feed = append(feed, buddyPosts...)
 
+		if err := attachReactions(db, userID, feed); err != nil {
+			http.Error(w, "Failed to load reactions", http.StatusInternalServerError)
+			log.Println("GetBuddyPosts reactions error:", err)
+			return
+		}
+		if err := attachCommentCounts(db, feed); err != nil {
+			http.Error(w, "Failed to load comment counts", http.StatusInternalServerError)
+			log.Println("GetBuddyPosts comment counts error:", err)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(feed)
 	}
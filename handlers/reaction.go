@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/models"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+// reactionEmojis is the fixed set of reactions clients can offer.
+var reactionEmojis = []string{"❤️", "😂", "😮", "😢", "🙌", "🔥"}
+
+func validReaction(emoji string) bool {
+	for _, e := range reactionEmojis {
+		if e == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+func GetReactionEmojis() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"emojis": reactionEmojis})
+	}
+}
+
+// reactablePostOwner returns the author of postID after checking that the
+// caller can see it and is not the author.
+func reactablePostOwner(db *sql.DB, w http.ResponseWriter, r *http.Request, postID int) (int, bool) {
+	callerID, _ := UserIDFromContext(r.Context())
+
+	ownerID, ok := requirePostAccess(db, w, postID, callerID)
+	if !ok {
+		return 0, false
+	}
+	if ownerID == callerID {
+		http.Error(w, "You cannot react to your own post", http.StatusBadRequest)
+		return 0, false
+	}
+	return ownerID, true
+}
+
+// SetReaction adds the caller's reaction to a post or replaces the one they
+// already left.
+func SetReaction(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid post id", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Emoji string `json:"emoji"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !validReaction(req.Emoji) {
+			http.Error(w, "Unsupported reaction", http.StatusBadRequest)
+			return
+		}
+
+		if !requireVerifiedEmail(db, w, r) {
+			return
+		}
+		ownerID, ok := reactablePostOwner(db, w, r, postID)
+		if !ok {
+			return
+		}
+		userID, _ := UserIDFromContext(r.Context())
+
+		// changed is false when the same emoji was already there, so tapping
+		// twice does not notify the author twice.
+		var changed bool
+		err = db.QueryRow(`
+			INSERT INTO post_reactions (post_id, user_id, emoji, created_at)
+			VALUES ($1, $2, $3, NOW())
+			ON CONFLICT (post_id, user_id)
+			DO UPDATE SET emoji = EXCLUDED.emoji, created_at = NOW()
+			WHERE post_reactions.emoji <> EXCLUDED.emoji
+			RETURNING TRUE`,
+			postID, userID, req.Emoji,
+		).Scan(&changed)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+			log.Println("SetReaction error:", err)
+			return
+		}
+
+		if changed {
+			go notifyAuthorOfReaction(db, ownerID, userID, postID, req.Emoji)
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"emoji": req.Emoji})
+	}
+}
+
+func DeleteReaction(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid post id", http.StatusBadRequest)
+			return
+		}
+		userID, _ := UserIDFromContext(r.Context())
+
+		_, err = db.Exec(`DELETE FROM post_reactions WHERE post_id = $1 AND user_id = $2`, postID, userID)
+		if err != nil {
+			http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
+			log.Println("DeleteReaction error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Reaction removed"})
+	}
+}
+
+// attachReactions fills in the reaction counts and the viewer's own reaction
+// for each post.
+func attachReactions(db *sql.DB, viewerID int, posts []models.PostWithUser) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(posts))
+	byID := make(map[int]*models.PostWithUser, len(posts))
+	for i := range posts {
+		posts[i].Reactions = map[string]int{}
+		ids[i] = int64(posts[i].ID)
+		byID[posts[i].ID] = &posts[i]
+	}
+
+	rows, err := db.Query(`
+		SELECT post_id, emoji, COUNT(*), BOOL_OR(user_id = $2)
+		FROM post_reactions
+		WHERE post_id = ANY($1)
+		GROUP BY post_id, emoji`,
+		pq.Array(ids), viewerID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID, count int
+		var emoji string
+		var mine bool
+		if err := rows.Scan(&postID, &emoji, &count, &mine); err != nil {
+			return err
+		}
+		p := byID[postID]
+		p.Reactions[emoji] = count
+		if mine {
+			p.MyReaction = emoji
+		}
+	}
+	return rows.Err()
+}
+
+// userFCMTokens returns the push tokens registered by the given users. Every
+// notification looks up its recipients' devices here.
+func userFCMTokens(db *sql.DB, userIDs ...int) ([]string, error) {
+	ids := make([]int64, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = int64(id)
+	}
+	rows, err := db.Query(`
+		SELECT DISTINCT token FROM fcm_tokens
+		WHERE user_id = ANY($1) AND token IS NOT NULL AND token != ''`,
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func notifyAuthorOfReaction(db *sql.DB, authorID, reactorID, postID int, emoji string) {
+	if hasMuted(db, authorID, reactorID) {
+		return
+	}
+
+	var displayName string
+	err := db.QueryRow(`SELECT display_name FROM users WHERE id = $1`, reactorID).Scan(&displayName)
+	if err != nil {
+		log.Printf("Error fetching user display name for notifications: %v", err)
+		displayName = "A friend"
+	}
+
+	tokens, err := userFCMTokens(db, authorID)
+	if err != nil {
+		log.Printf("Error fetching FCM tokens for user %d: %v", authorID, err)
+		return
+	}
+	if len(tokens) == 0 {
+		return
+	}
+
+	data := map[string]string{
+		"type":    "reaction",
+		"post_id": strconv.Itoa(postID),
+		"user_id": strconv.Itoa(reactorID),
+		"emoji":   emoji,
+	}
+
+	_, _, err = services.SendMultipleNotifications(
+		tokens,
+		fmt.Sprintf("%s reacted to your post", displayName),
+		emoji,
+		data,
+	)
+	if err != nil {
+		log.Printf("Failed to send reaction notification: %v", err)
+	}
+}
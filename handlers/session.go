@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+// Values of refresh_tokens.revoked_reason.
+const (
+	revokedRotated   = "rotated"
+	revokedReuse     = "reuse"
+	revokedSignedOut = "signed_out"
+)
+
+// sessionCacheTTL is how long a session is remembered as live, and so how
+// long an access token can outlive a revocation made on another instance.
+const sessionCacheTTL = 30 * time.Second
+
+type cachedSession struct {
+	userID    int
+	expiresAt time.Time
+}
+
+var (
+	liveSessions   = map[string]cachedSession{}
+	liveSessionsMu sync.Mutex
+)
+
+// sessionActive reports whether sessionID still has a usable refresh token,
+// so access tokens stop working soon after their session is revoked.
+func sessionActive(db *sql.DB, userID int, sessionID string) (bool, error) {
+	if sessionID == "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	liveSessionsMu.Lock()
+	cached, ok := liveSessions[sessionID]
+	liveSessionsMu.Unlock()
+	if ok && cached.userID == userID && now.Before(cached.expiresAt) {
+		return true, nil
+	}
+
+	var active bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM refresh_tokens
+		              WHERE family_id::text = $1 AND user_id = $2
+		                AND revoked = FALSE AND expires_at > NOW())`,
+		sessionID, userID,
+	).Scan(&active)
+	if err != nil || !active {
+		return false, err
+	}
+
+	liveSessionsMu.Lock()
+	defer liveSessionsMu.Unlock()
+	for id, s := range liveSessions {
+		if now.After(s.expiresAt) {
+			delete(liveSessions, id)
+		}
+	}
+	liveSessions[sessionID] = cachedSession{userID: userID, expiresAt: now.Add(sessionCacheTTL)}
+	return true, nil
+}
+
+// forgetSessions drops userID's sessions from the cache, or only sessionID
+// when it is not empty.
+func forgetSessions(userID int, sessionID string) {
+	liveSessionsMu.Lock()
+	defer liveSessionsMu.Unlock()
+	for id, s := range liveSessions {
+		if s.userID == userID && (sessionID == "" || id == sessionID) {
+			delete(liveSessions, id)
+		}
+	}
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// revokeUserSessions signs out every live session of userID, leaving out
+// the session exceptSessionID when it is not empty. Callers run
+// forgetSessions once the change is committed, so that a concurrent request
+// cannot put the old state back in the cache before then.
+func revokeUserSessions(db execer, userID int, exceptSessionID string) (int64, error) {
+	result, err := db.Exec(`
+		UPDATE refresh_tokens
+		SET revoked = TRUE, revoked_at = NOW(), revoked_reason = $3
+		WHERE user_id = $1
+		  AND revoked = FALSE
+		  AND family_id::text != $2`,
+		userID, exceptSessionID, revokedSignedOut)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func GetSessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+		currentSessionID := sessionIDFromContext(r.Context())
+
+		rows, err := db.Query(`
+			SELECT rt.family_id,
+			       COALESCE(rt.device_name, ''),
+			       COALESCE(rt.user_agent, ''),
+			       COALESCE(rt.ip_address, ''),
+			       (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id),
+			       COALESCE(rt.last_used_at, rt.created_at) AS last_used_at
+			FROM refresh_tokens rt
+			WHERE rt.user_id = $1
+			  AND rt.revoked = FALSE
+			  AND rt.expires_at > NOW()
+			ORDER BY last_used_at DESC`,
+			userID)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("GetSessions error:", err)
+			return
+		}
+		defer rows.Close()
+
+		sessions := []models.Session{}
+		for rows.Next() {
+			var s models.Session
+			if err := rows.Scan(
+				&s.ID,
+				&s.DeviceName,
+				&s.UserAgent,
+				&s.IPAddress,
+				&s.CreatedAt,
+				&s.LastUsedAt,
+			); err != nil {
+				http.Error(w, "Error scanning sessions", http.StatusInternalServerError)
+				log.Println("GetSessions scan error:", err)
+				return
+			}
+			s.Current = s.ID == currentSessionID
+			sessions = append(sessions, s)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating sessions", http.StatusInternalServerError)
+			log.Println("GetSessions rows error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+func RevokeSession(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+		sessionID := mux.Vars(r)["id"]
+
+		result, err := db.Exec(`
+			UPDATE refresh_tokens
+			SET revoked = TRUE, revoked_at = NOW(), revoked_reason = $3
+			WHERE user_id = $1
+			  AND family_id::text = $2
+			  AND revoked = FALSE`,
+			userID, sessionID, revokedSignedOut)
+		if err != nil {
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			log.Println("RevokeSession error:", err)
+			return
+		}
+
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		forgetSessions(userID, sessionID)
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked successfully"})
+	}
+}
+
+func LogoutAllHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		if _, err := revokeUserSessions(db, userID, ""); err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			log.Println("LogoutAllHandler error:", err)
+			return
+		}
+		forgetSessions(userID, "")
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Logged out of all sessions"})
+	}
+}
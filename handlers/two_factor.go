@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"masterboxer.com/project-micro-journal/models"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const (
+	twoFactorChallengeTokenType = "2fa_challenge"
+	twoFactorChallengeTTL       = 5 * time.Minute
+
+	totpIssuer        = "Micro Journal"
+	recoveryCodeCount = 10
+)
+
+func createTwoFactorChallengeToken(userID int) (string, error) {
+	claims, err := newTokenClaims(userID, "", twoFactorChallengeTokenType, twoFactorChallengeTTL)
+	if err != nil {
+		return "", err
+	}
+	return services.AccessKeys().Sign(claims)
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// replaceRecoveryCodes discards any existing recovery codes and returns a new
+// set. Only hashes are stored, so this is the one time they can be shown.
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := randomToken(5)
+		if err != nil {
+			return nil, err
+		}
+		code := raw[:5] + "-" + raw[5:]
+
+		_, err = tx.Exec(`
+			INSERT INTO totp_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)`, userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// execQuerier is satisfied by both *sql.DB and *sql.Tx.
+type execQuerier interface {
+	execer
+	querier
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+// A TOTP time step is only accepted once, and a recovery code is used up.
+func checkSecondFactor(db execQuerier, userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		result, err := db.Exec(`
+			UPDATE totp_recovery_codes
+			SET used_at = NOW()
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+			userID, hashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return false, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		return rowsAffected == 1, err
+	}
+
+	var secret sql.NullString
+	err := db.QueryRow("SELECT totp_secret FROM users WHERE id = $1", userID).Scan(&secret)
+	if err != nil {
+		return false, err
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+
+	step, ok := services.ValidateTOTP(secret.String, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	result, err := db.Exec(`
+		UPDATE users
+		SET totp_last_step = $1
+		WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)`,
+		step, userID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func EnrollTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		var email string
+		var enabled bool
+		err := db.QueryRow("SELECT email, totp_enabled FROM users WHERE id = $1", userID).Scan(&email, &enabled)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("EnrollTwoFactor lookup error:", err)
+			return
+		}
+
+		if enabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		secret, err := services.GenerateTOTPSecret()
+		if err != nil {
+			http.Error(w, "Could not create secret", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = db.Exec("UPDATE users SET totp_secret = $1, totp_last_step = NULL WHERE id = $2", secret, userID)
+		if err != nil {
+			http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+			log.Println("EnrollTwoFactor update error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":      secret,
+			"otpauth_uri": services.TOTPURI(totpIssuer, email, secret),
+		})
+	}
+}
+
+func ConfirmTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var secret sql.NullString
+		var enabled bool
+		err := db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = $1", userID).Scan(&secret, &enabled)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("ConfirmTwoFactor lookup error:", err)
+			return
+		}
+
+		if enabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		if !secret.Valid {
+			http.Error(w, "Start enrollment first", http.StatusBadRequest)
+			return
+		}
+
+		step, ok := services.ValidateTOTP(secret.String, req.Code, time.Now())
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("ConfirmTwoFactor begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2", step, userID)
+		if err != nil {
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			log.Println("ConfirmTwoFactor update error:", err)
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(tx, userID)
+		if err != nil {
+			http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+			log.Println("ConfirmTwoFactor recovery codes error:", err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			log.Println("ConfirmTwoFactor commit error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Two-factor authentication enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+func DisableTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		var req struct {
+			Password     string `json:"password"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var hash string
+		var enabled bool
+		err := db.QueryRow("SELECT password, totp_enabled FROM users WHERE id = $1", userID).Scan(&hash, &enabled)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("DisableTwoFactor lookup error:", err)
+			return
+		}
+
+		if !enabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
+			http.Error(w, "Password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		ok, err := checkSecondFactor(db, userID, req.Code, req.RecoveryCode)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("DisableTwoFactor check error:", err)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("DisableTwoFactor begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`
+			UPDATE users
+			SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = NULL
+			WHERE id = $1`, userID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+			log.Println("DisableTwoFactor update error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+	}
+}
+
+func RegenerateRecoveryCodes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var enabled bool
+		if err := db.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", userID).Scan(&enabled); err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("RegenerateRecoveryCodes lookup error:", err)
+			return
+		}
+		if !enabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+			return
+		}
+
+		ok, err := checkSecondFactor(db, userID, req.Code, "")
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("RegenerateRecoveryCodes check error:", err)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("RegenerateRecoveryCodes begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		codes, err := replaceRecoveryCodes(tx, userID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+			log.Println("RegenerateRecoveryCodes error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// VerifyTwoFactorLogin is the second step of a login for accounts with 2FA.
+// It trades the challenge token from LoginHandler and a valid code for the
+// usual token pair. Each challenge token can be used for one login.
+func VerifyTwoFactorLogin(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+			RecoveryCode   string `json:"recovery_code"`
+			DeviceName     string `json:"device_name,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Code == "" && req.RecoveryCode == "" {
+			http.Error(w, "code or recovery_code is required", http.StatusBadRequest)
+			return
+		}
+
+		claims, userID, err := parseToken(req.ChallengeToken, services.AccessKeys(), twoFactorChallengeTokenType)
+		if err != nil {
+			http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+			return
+		}
+
+		var user models.User
+		err = db.QueryRow(`SELECT id, username, display_name, email, role
+			FROM users WHERE id = $1 AND totp_enabled`, userID).
+			Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Role)
+		if err != nil {
+			http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+			return
+		}
+
+		guard := services.GetLoginGuard()
+		ip := clientIP(r)
+
+		wait, err := guard.RetryAfter(user.Email, ip)
+		if err != nil {
+			log.Println("VerifyTwoFactorLogin attempt lookup error:", err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("VerifyTwoFactorLogin begin error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		// The challenge can only complete one login. It is claimed before the
+		// code is checked so that a replayed challenge cannot use up a
+		// recovery code; a wrong code rolls the claim back.
+		result, err := tx.Exec(`
+			INSERT INTO used_two_factor_challenges (jti, expires_at)
+			VALUES ($1, $2)
+			ON CONFLICT (jti) DO NOTHING`,
+			claims.ID, claims.ExpiresAt.Time)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("VerifyTwoFactorLogin challenge record error:", err)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+			return
+		}
+
+		ok, err := checkSecondFactor(tx, user.ID, req.Code, req.RecoveryCode)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("VerifyTwoFactorLogin check error:", err)
+			return
+		}
+		if !ok {
+			wait, recordErr := guard.RecordFailure(user.Email, ip)
+			if recordErr != nil {
+				log.Println("VerifyTwoFactorLogin attempt record error:", recordErr)
+			}
+			if wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Println("VerifyTwoFactorLogin commit error:", err)
+			return
+		}
+
+		if err := guard.RecordSuccess(user.Email); err != nil {
+			log.Println("VerifyTwoFactorLogin attempt reset error:", err)
+		}
+
+		writeLoginResponse(w, r, db, user, req.DeviceName)
+	}
+}
+
+// cleanupUsedTwoFactorChallenges forgets challenges that have expired anyway.
+func cleanupUsedTwoFactorChallenges(db *sql.DB) error {
+	_, err := db.Exec(`DELETE FROM used_two_factor_challenges WHERE expires_at < NOW()`)
+	return err
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const (
+	photoKeyPrefix = "photos/"
+	photoURLTTL    = time.Hour
+)
+
+var (
+	maxUploadBytes     int64
+	maxUploadBytesOnce sync.Once
+)
+
+// currentMaxUploadBytes reads UPLOAD_MAX_MB (default 10) on first use.
+func currentMaxUploadBytes() int64 {
+	maxUploadBytesOnce.Do(func() {
+		maxUploadBytes = 10 << 20
+		if n, err := strconv.Atoi(os.Getenv("UPLOAD_MAX_MB")); err == nil && n > 0 {
+			maxUploadBytes = int64(n) << 20
+		}
+	})
+	return maxUploadBytes
+}
+
+// photoURL turns a stored photo key into a short-lived link for clients.
+// Paths that did not come from UploadPhoto are not ours to sign.
+func photoURL(key string) string {
+	if !strings.HasPrefix(key, photoKeyPrefix) {
+		return ""
+	}
+	u, err := services.Blobs().URL(key, photoURLTTL)
+	if err != nil {
+		log.Printf("Failed to sign photo URL for %s: %v", key, err)
+		return ""
+	}
+	return u
+}
+
+var (
+	errPhotoNotUploaded = errors.New("photo_path must be a photo you uploaded with POST /uploads")
+	errPhotoInUse       = errors.New("This photo is already attached to another post")
+)
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkPhotoUpload verifies that key was uploaded by userID and is not
+// attached to a post other than postID. Pass 0 for a post that does not
+// exist yet. Inside a transaction the upload stays locked until
+// attachPhotoUpload claims it.
+func checkPhotoUpload(db querier, userID, postID int, key string) error {
+	var owner int
+	var attachedTo sql.NullInt64
+	err := db.QueryRow(`SELECT user_id, post_id FROM uploads WHERE storage_key = $1 FOR UPDATE`, key).
+		Scan(&owner, &attachedTo)
+	if err == sql.ErrNoRows || (err == nil && owner != userID) {
+		return errPhotoNotUploaded
+	}
+	if err != nil {
+		return err
+	}
+	if attachedTo.Valid && int(attachedTo.Int64) != postID {
+		return errPhotoInUse
+	}
+	return nil
+}
+
+// attachPhotoUpload marks key as the photo of postID. It only succeeds while
+// the upload belongs to userID and is free or already on this post, so a
+// photo that was claimed since checkPhotoUpload is reported as in use.
+func attachPhotoUpload(db execer, userID, postID int, key string) error {
+	result, err := db.Exec(`
+		UPDATE uploads SET post_id = $1
+		WHERE storage_key = $2 AND user_id = $3 AND (post_id IS NULL OR post_id = $1)`,
+		postID, key, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errPhotoInUse
+	}
+	return nil
+}
+
+// userPhotoKeys returns every photo userID has uploaded, attached or not.
+func userPhotoKeys(db *sql.DB, userID int) ([]string, error) {
+	rows, err := db.Query(`SELECT storage_key FROM uploads WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// deletePhoto removes a post's photo and its resized variants from storage
+// once the post is gone.
+func deletePhoto(db *sql.DB, key string) {
+	if !deletePhotoBlobs(key) {
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM uploads WHERE storage_key = $1`, key); err != nil {
+		log.Printf("Failed to delete upload record for %s: %v", key, err)
+	}
+}
+
+// deletePhotoBlobs removes a photo and its variants from storage. It reports
+// whether the original is gone.
+func deletePhotoBlobs(key string) bool {
+	if !strings.HasPrefix(key, photoKeyPrefix) {
+		return false
+	}
+	for _, variant := range []string{variantKey(key, "thumb"), variantKey(key, "medium")} {
+		if err := services.Blobs().Delete(context.Background(), variant); err != nil {
+			log.Printf("Failed to delete photo variant %s: %v", variant, err)
+		}
+	}
+	if err := services.Blobs().Delete(context.Background(), key); err != nil {
+		log.Printf("Failed to delete photo %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// unattachedUploadTTL is how long an upload may wait to be attached to a
+// post before it is deleted.
+const unattachedUploadTTL = 24 * time.Hour
+
+// StartUploadCleanup deletes abandoned uploads every interval in the
+// background.
+func StartUploadCleanup(db *sql.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			deleted, err := cleanupUnattachedUploads(db)
+			if err != nil {
+				log.Printf("Error cleaning up unattached uploads: %v", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Cleaned up %d unattached uploads", deleted)
+			}
+		}
+	}()
+}
+
+// cleanupUnattachedUploads deletes uploads that were never attached to a
+// post, or whose post is gone. The rows go first so that CreatePost cannot
+// attach a photo whose blob is about to be deleted.
+func cleanupUnattachedUploads(db *sql.DB) (int, error) {
+	rows, err := db.Query(`
+		DELETE FROM uploads
+		WHERE post_id IS NULL AND created_at < NOW() - $1 * INTERVAL '1 second'
+		RETURNING storage_key`,
+		int(unattachedUploadTTL.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		deletePhotoBlobs(key)
+	}
+	return len(keys), nil
+}
+
+// UploadPhoto accepts a multipart form with a "photo" file, strips its
+// metadata and stores it. The returned photo_path can then be sent with
+// CreatePost.
+func UploadPhoto(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+		if !requireVerifiedEmail(db, w, r) {
+			return
+		}
+
+		limit := currentMaxUploadBytes()
+		// Leave some room for the multipart framing around the file.
+		r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+
+		file, _, err := r.FormFile("photo")
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, fmt.Sprintf("Photo must be at most %d MB", limit>>20), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "A multipart form with a photo file is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, limit+1))
+		if err != nil {
+			http.Error(w, "Could not read photo", http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) > limit {
+			http.Error(w, fmt.Sprintf("Photo must be at most %d MB", limit>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		img, err := services.SanitizeImage(data)
+		if err != nil {
+			if err == services.ErrUnsupportedImage {
+				http.Error(w, "Photo must be a JPEG or PNG image", http.StatusUnsupportedMediaType)
+			} else {
+				http.Error(w, "Could not process photo", http.StatusBadRequest)
+				log.Println("UploadPhoto decode error:", err)
+			}
+			return
+		}
+
+		name, err := randomToken(16)
+		if err != nil {
+			http.Error(w, "Could not store photo", http.StatusInternalServerError)
+			return
+		}
+		key := fmt.Sprintf("%s%d/%s%s", photoKeyPrefix, userID, name, img.Extension)
+
+		err = services.Blobs().Put(r.Context(), key, bytes.NewReader(img.Data), int64(len(img.Data)), img.ContentType)
+		if err != nil {
+			http.Error(w, "Could not store photo", http.StatusInternalServerError)
+			log.Println("UploadPhoto store error:", err)
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO uploads (user_id, storage_key, content_type, size_bytes, width, height)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			userID, key, img.ContentType, len(img.Data), img.Width, img.Height)
+		if err != nil {
+			http.Error(w, "Could not store photo", http.StatusInternalServerError)
+			log.Println("UploadPhoto insert error:", err)
+			return
+		}
+		queuePhotoVariants()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"photo_path":   key,
+			"photo_url":    photoURL(key),
+			"content_type": img.ContentType,
+			"width":        img.Width,
+			"height":       img.Height,
+		})
+	}
+}
+
+// ServeMedia serves files from the local blob store to holders of a signed
+// link. Other backends hand out their own URLs.
+func ServeMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store, ok := services.Blobs().(*services.LocalBlobStore)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		key := mux.Vars(r)["key"]
+		q := r.URL.Query()
+		if !store.VerifyURL(key, q.Get("expires"), q.Get("sig")) {
+			http.Error(w, "Invalid or expired link", http.StatusForbidden)
+			return
+		}
+
+		f, err := store.Open(key)
+		if err != nil {
+			if err != services.ErrBlobNotFound {
+				log.Println("ServeMedia open error:", err)
+			}
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "Could not read file", http.StatusInternalServerError)
+			return
+		}
+
+		contentType := "application/octet-stream"
+		switch {
+		case strings.HasSuffix(key, ".jpg"):
+			contentType = "image/jpeg"
+		case strings.HasSuffix(key, ".png"):
+			contentType = "image/png"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		http.ServeContent(w, r, "", info.ModTime(), f)
+	}
+}
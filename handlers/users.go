@@ -12,13 +12,12 @@ import (
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 	"masterboxer.com/project-micro-journal/models"
-	"masterboxer.com/project-micro-journal/services"
 )
 
 func GetUsers(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		rows, err := db.Query(`SELECT id, username, display_name, dob, 
-            gender, email, password, created_at FROM users`)
+            gender, email, email_verified, role, timezone, default_post_visibility, password, created_at FROM users`)
 		if err != nil {
 			http.Error(w, "Database query failed", http.StatusInternalServerError)
 			log.Println(err)
@@ -30,7 +29,8 @@ func GetUsers(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var u models.User
 			if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.DOB,
-				&u.Gender, &u.Email, &u.Password, &u.CreatedAt); err != nil {
+				&u.Gender, &u.Email, &u.EmailVerified, &u.Role, &u.Timezone, &u.DefaultPostVisibility,
+				&u.Password, &u.CreatedAt); err != nil {
 				http.Error(w, "Error scanning user data", http.StatusInternalServerError)
 				log.Println(err)
 				return
@@ -55,9 +55,10 @@ func GetUserById(db *sql.DB) http.HandlerFunc {
 
 		var u models.User
 		err := db.QueryRow(`SELECT id, username, display_name, dob, 
-            gender, email, password, created_at FROM users WHERE id = $1`, id).
+            gender, email, email_verified, role, timezone, default_post_visibility, password, created_at
+            FROM users WHERE id = $1`, id).
 			Scan(&u.ID, &u.Username, &u.DisplayName, &u.DOB, &u.Gender, &u.Email,
-				&u.Password, &u.CreatedAt)
+				&u.EmailVerified, &u.Role, &u.Timezone, &u.DefaultPostVisibility, &u.Password, &u.CreatedAt)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "User not found", http.StatusNotFound)
@@ -76,10 +77,18 @@ func GetUserById(db *sql.DB) http.HandlerFunc {
 func DeleteUser(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		id := vars["id"]
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if !requireSelf(w, r, id) {
+			return
+		}
 
 		var u models.User
-		err := db.QueryRow("SELECT id, username, email FROM users WHERE id = $1", id).
+		err = db.QueryRow("SELECT id, username, email FROM users WHERE id = $1", id).
 			Scan(&u.ID, &u.Username, &u.Email)
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -91,6 +100,15 @@ func DeleteUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Upload records go with the account, so the blobs they point at
+		// have to be collected first.
+		photos, err := userPhotoKeys(db, id)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
 		_, err = db.Exec("DELETE FROM users WHERE id = $1", id)
 		if err != nil {
 			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
@@ -98,10 +116,27 @@ func DeleteUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		go func() {
+			for _, key := range photos {
+				deletePhoto(db, key)
+			}
+		}()
+
 		json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
 	}
 }
 
+const defaultTimezone = "UTC"
+
+// validTimezone reports whether name is an IANA time zone the server knows.
+func validTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
 func CreateUser(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var u models.User
@@ -130,16 +165,45 @@ func CreateUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if u.Timezone == "" {
+			u.Timezone = defaultTimezone
+		}
+		if !validTimezone(u.Timezone) {
+			http.Error(w, "timezone must be an IANA time zone such as Europe/Berlin", http.StatusBadRequest)
+			return
+		}
+
+		if u.DefaultPostVisibility == "" {
+			u.DefaultPostVisibility = models.VisibilityBuddies
+		}
+		if !validPostVisibility(u.DefaultPostVisibility) {
+			http.Error(w, "default_post_visibility must be private, buddies or public", http.StatusBadRequest)
+			return
+		}
+
+		if err := currentPasswordPolicy().Validate(u.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 		if err != nil {
 			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 			return
 		}
 
-		err = db.QueryRow(
-			`INSERT INTO users (username, display_name, dob, gender, email, password, created_at) 
-            VALUES ($1, $2, $3, $4, $5, $6, NOW()) RETURNING id, created_at`,
-			u.Username, u.DisplayName, u.DOB, u.Gender, u.Email, string(hashedPassword),
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(
+			`INSERT INTO users (username, display_name, dob, gender, email, password, timezone, default_post_visibility, created_at) 
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW()) RETURNING id, created_at`,
+			u.Username, u.DisplayName, u.DOB, u.Gender, u.Email, string(hashedPassword), u.Timezone,
+			u.DefaultPostVisibility,
 		).Scan(&u.ID, &u.CreatedAt)
 
 		if err != nil {
@@ -148,7 +212,38 @@ func CreateUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// A bad invite code fails the sign-up so the user can fix it rather
+		// than end up with an account and no buddy.
+		inviterID := 0
+		if strings.TrimSpace(u.InviteCode) != "" {
+			inviterID, err = redeemInvite(tx, u.InviteCode, u.ID, true)
+			if err != nil {
+				status := inviteErrorStatus(err)
+				if status == http.StatusInternalServerError {
+					http.Error(w, "Failed to create user", status)
+					log.Println("CreateUser invite error:", err)
+					return
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		go sendVerificationEmail(u.ID, u.Email)
+		if inviterID != 0 {
+			go notifyInviter(db, inviterID, u.ID, true)
+		}
+
 		u.Password = ""
+		u.InviteCode = ""
+		u.EmailVerified = false
+		u.Role = models.RoleUser
 		json.NewEncoder(w).Encode(u)
 	}
 }
@@ -162,7 +257,15 @@ func UpdateUser(db *sql.DB) http.HandlerFunc {
 		}
 
 		vars := mux.Vars(r)
-		id := vars["id"]
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if !requireSelf(w, r, id) {
+			return
+		}
 
 		setClauses := []string{}
 		args := []interface{}{}
@@ -178,10 +281,38 @@ func UpdateUser(db *sql.DB) http.HandlerFunc {
 			args = append(args, u.DisplayName)
 			i++
 		}
+		// A new email only replaces the current one once it has been confirmed.
+		emailChanged := false
 		if u.Email != "" {
-			setClauses = append(setClauses, "email = $"+strconv.Itoa(i))
-			args = append(args, u.Email)
-			i++
+			var currentEmail string
+			if err := db.QueryRow("SELECT email FROM users WHERE id = $1", id).Scan(&currentEmail); err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "User not found", http.StatusNotFound)
+				} else {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println(err)
+				}
+				return
+			}
+
+			if u.Email != currentEmail {
+				var taken bool
+				err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", u.Email).Scan(&taken)
+				if err != nil {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println(err)
+					return
+				}
+				if taken {
+					http.Error(w, "Email is already in use", http.StatusConflict)
+					return
+				}
+
+				setClauses = append(setClauses, "pending_email = $"+strconv.Itoa(i))
+				args = append(args, u.Email)
+				i++
+				emailChanged = true
+			}
 		}
 		if !time.Time(u.DOB).IsZero() {
 			if time.Time(u.DOB).After(time.Now()) {
@@ -197,6 +328,49 @@ func UpdateUser(db *sql.DB) http.HandlerFunc {
 			args = append(args, u.Gender)
 			i++
 		}
+		if u.Timezone != "" {
+			if !validTimezone(u.Timezone) {
+				http.Error(w, "timezone must be an IANA time zone such as Europe/Berlin", http.StatusBadRequest)
+				return
+			}
+			// Moving to a zone where it is a different date would otherwise
+			// allow a second post on the same real day.
+			var postedToday bool
+			err := db.QueryRow(`
+				SELECT u.timezone <> $2 AND EXISTS(
+				           SELECT 1 FROM posts p
+				           WHERE p.user_id = u.id
+				             AND p.local_date = (NOW() AT TIME ZONE u.timezone)::date)
+				FROM users u
+				WHERE u.id = $1`,
+				id, u.Timezone,
+			).Scan(&postedToday)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "User not found", http.StatusNotFound)
+				} else {
+					http.Error(w, "Database query failed", http.StatusInternalServerError)
+					log.Println(err)
+				}
+				return
+			}
+			if postedToday {
+				http.Error(w, "Your timezone can't be changed on a day you have already posted", http.StatusConflict)
+				return
+			}
+			setClauses = append(setClauses, "timezone = $"+strconv.Itoa(i))
+			args = append(args, u.Timezone)
+			i++
+		}
+		if u.DefaultPostVisibility != "" {
+			if !validPostVisibility(u.DefaultPostVisibility) {
+				http.Error(w, "default_post_visibility must be private, buddies or public", http.StatusBadRequest)
+				return
+			}
+			setClauses = append(setClauses, "default_post_visibility = $"+strconv.Itoa(i))
+			args = append(args, u.DefaultPostVisibility)
+			i++
+		}
 
 		if len(setClauses) == 0 {
 			http.Error(w, "No fields provided for update", http.StatusBadRequest)
@@ -207,19 +381,26 @@ func UpdateUser(db *sql.DB) http.HandlerFunc {
 			" WHERE id = $" + strconv.Itoa(i)
 		args = append(args, id)
 
-		_, err := db.Exec(sqlStr, args...)
+		_, err = db.Exec(sqlStr, args...)
 		if err != nil {
 			http.Error(w, "Database update failed", http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
 
+		if emailChanged {
+			go sendVerificationEmail(id, u.Email)
+		}
+
 		var updatedUser models.User
 		err = db.QueryRow(`SELECT id, username, display_name, dob, 
-            gender, email, password, created_at FROM users WHERE id = $1`, id).
+            gender, email, email_verified, COALESCE(pending_email, ''), timezone, default_post_visibility,
+            password, created_at
+            FROM users WHERE id = $1`, id).
 			Scan(&updatedUser.ID, &updatedUser.Username, &updatedUser.DisplayName,
 				&updatedUser.DOB, &updatedUser.Gender, &updatedUser.Email,
-				&updatedUser.Password, &updatedUser.CreatedAt)
+				&updatedUser.EmailVerified, &updatedUser.PendingEmail, &updatedUser.Timezone,
+				&updatedUser.DefaultPostVisibility, &updatedUser.Password, &updatedUser.CreatedAt)
 
 		if err != nil {
 			http.Error(w, "Failed to fetch updated user", http.StatusInternalServerError)
@@ -237,6 +418,10 @@ func GetUserBuddies(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		userID, _ := strconv.Atoi(vars["user_id"])
 
+		if !requireSelf(w, r, userID) {
+			return
+		}
+
 		rows, err := db.Query(`
             SELECT u.id, u.username, u.display_name 
             FROM buddies b 
@@ -264,60 +449,21 @@ func GetUserBuddies(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func AddBuddy(db *sql.DB) http.HandlerFunc {
+func RemoveBuddy(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		userID, _ := strconv.Atoi(vars["user_id"])
+		buddyID, _ := strconv.Atoi(vars["buddy_id"])
 
-		var req struct {
-			BuddyID int `json:"buddy_id"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		if req.BuddyID == userID {
-			http.Error(w, "Cannot add self as buddy", http.StatusBadRequest)
-			return
-		}
-
-		var exists bool
-		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", req.BuddyID).Scan(&exists)
-		if err != nil {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			log.Println("Error checking buddy existence:", err)
-			return
-		}
-
-		if !exists {
-			http.Error(w, "Buddy user not found", http.StatusNotFound)
-			return
-		}
-
-		_, err = db.Exec(`
-            INSERT INTO buddies (user_id, buddy_id) 
-            VALUES ($1, $2) 
-            ON CONFLICT (user_id, buddy_id) DO NOTHING`,
-			userID, req.BuddyID)
-		if err != nil {
-			http.Error(w, "Failed to add buddy", http.StatusInternalServerError)
-			log.Println(err)
+		if !requireSelf(w, r, userID) {
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Buddy added successfully"})
-	}
-}
-
-func RemoveBuddy(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userID, _ := strconv.Atoi(vars["user_id"])
-		buddyID, _ := strconv.Atoi(vars["buddy_id"])
-
-		result, err := db.Exec("DELETE FROM buddies WHERE user_id = $1 AND buddy_id = $2", userID, buddyID)
+		// Either side can end the relationship, in both directions.
+		result, err := db.Exec(`
+			DELETE FROM buddies
+			WHERE (user_id = $1 AND buddy_id = $2) OR (user_id = $2 AND buddy_id = $1)`,
+			userID, buddyID)
 		if err != nil {
 			http.Error(w, "Failed to remove buddy", http.StatusInternalServerError)
 			log.Println(err)
@@ -329,6 +475,18 @@ func RemoveBuddy(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Neither stays in the other's circles, so becoming buddies again
+		// does not quietly restore access to circle-only posts.
+		_, err = db.Exec(`
+			DELETE FROM circle_members cm
+			USING circles c
+			WHERE cm.circle_id = c.id
+			  AND ((c.owner_id = $1 AND cm.member_id = $2) OR (c.owner_id = $2 AND cm.member_id = $1))`,
+			userID, buddyID)
+		if err != nil {
+			log.Println("RemoveBuddy circle members error:", err)
+		}
+
 		json.NewEncoder(w).Encode(map[string]string{"message": "Buddy removed successfully"})
 	}
 }
@@ -344,12 +502,17 @@ func SearchUsers(db *sql.DB) http.HandlerFunc {
 		if len(query) > 50 {
 			query = query[:50]
 		}
+		callerID, _ := UserIDFromContext(r.Context())
 
 		rows, err := db.Query(`
 			SELECT id, username, display_name, dob, gender, email, created_at
 			FROM users 
-			WHERE username ILIKE $1 
-			   OR display_name ILIKE $1
+			WHERE (username ILIKE $1 
+			   OR display_name ILIKE $1)
+			  -- Nobody finds a user who blocked them, or one they blocked.
+			  AND NOT EXISTS(SELECT 1 FROM user_blocks b
+			                 WHERE (b.blocker_id = users.id AND b.blocked_id = $3)
+			                    OR (b.blocker_id = $3 AND b.blocked_id = users.id))
 			ORDER BY 
 				-- Prioritize exact matches first, then partial
 				CASE WHEN username ILIKE $2 THEN 0 ELSE 1 END +
@@ -359,7 +522,8 @@ func SearchUsers(db *sql.DB) http.HandlerFunc {
 				LENGTH(display_name) - LENGTH($1)
 			LIMIT 20`,
 			"%"+query+"%",
-			query+"%")
+			query+"%",
+			callerID)
 		if err != nil {
 			http.Error(w, "Database search failed", http.StatusInternalServerError)
 			log.Println("SearchUsers error:", err)
@@ -404,7 +568,10 @@ func RegisterFCMToken(db *sql.DB) http.HandlerFunc {
 		}
 
 		if req.UserID == 0 {
-			http.Error(w, "User ID is required", http.StatusBadRequest)
+			req.UserID, _ = UserIDFromContext(r.Context())
+		}
+
+		if !requireSelf(w, r, req.UserID) {
 			return
 		}
 
@@ -428,97 +595,6 @@ func RegisterFCMToken(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func AddBuddyWithNotification(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		userID, _ := strconv.Atoi(vars["user_id"])
-
-		var req struct {
-			BuddyID int `json:"buddy_id"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		if req.BuddyID == userID {
-			http.Error(w, "Cannot add self as buddy", http.StatusBadRequest)
-			return
-		}
-
-		var displayName string
-		err := db.QueryRow("SELECT display_name FROM users WHERE id = $1", userID).Scan(&displayName)
-		if err != nil {
-			http.Error(w, "User not found", http.StatusNotFound)
-			log.Println("Error getting username:", err)
-			return
-		}
-
-		var buddyExists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", req.BuddyID).Scan(&buddyExists)
-		if err != nil || !buddyExists {
-			http.Error(w, "Buddy user not found", http.StatusNotFound)
-			return
-		}
-
-		_, err = db.Exec(`
-            INSERT INTO buddies (user_id, buddy_id) 
-            VALUES ($1, $2) 
-            ON CONFLICT (user_id, buddy_id) DO NOTHING`,
-			userID, req.BuddyID)
-		if err != nil {
-			http.Error(w, "Failed to add buddy", http.StatusInternalServerError)
-			log.Println(err)
-			return
-		}
-
-		go func() {
-			rows, err := db.Query(`
-				SELECT token FROM fcm_tokens 
-				WHERE user_id = $1 AND token IS NOT NULL AND token != ''`,
-				req.BuddyID)
-			if err != nil {
-				log.Printf("Error fetching buddy FCM tokens: %v", err)
-				return
-			}
-			defer rows.Close()
-
-			var tokens []string
-			for rows.Next() {
-				var token string
-				if err := rows.Scan(&token); err != nil {
-					log.Printf("Error scanning token: %v", err)
-					continue
-				}
-				tokens = append(tokens, token)
-			}
-
-			if len(tokens) == 0 {
-				log.Printf("No FCM tokens found for buddy %d", req.BuddyID)
-				return
-			}
-
-			data := map[string]string{
-				"type":    "buddy_added",
-				"user_id": strconv.Itoa(userID),
-			}
-
-			_, _, err = services.SendMultipleNotifications(
-				tokens,
-				"New Buddy Request",
-				displayName+" added you as a buddy!",
-				data,
-			)
-			if err != nil {
-				log.Printf("Failed to send buddy notification: %v", err)
-			}
-		}()
-
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Buddy added successfully"})
-	}
-}
-
 type TokenRequest struct {
 	Token     string `json:"token"`
 	UserID    int    `json:"user_id"`
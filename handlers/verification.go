@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+	"masterboxer.com/project-micro-journal/services"
+)
+
+const (
+	emailVerificationTokenType = "email_verification"
+	emailVerificationTTL       = 48 * time.Hour
+)
+
+func createEmailVerificationToken(userID int, email string) (string, error) {
+	claims, err := newTokenClaims(userID, "", emailVerificationTokenType, emailVerificationTTL)
+	if err != nil {
+		return "", err
+	}
+	claims.Email = email
+	return services.AccessKeys().Sign(claims)
+}
+
+// sendVerificationEmail mails a signed link confirming that userID owns email.
+func sendVerificationEmail(userID int, email string) {
+	token, err := createEmailVerificationToken(userID, email)
+	if err != nil {
+		log.Printf("Failed to create verification token for user %d: %v", userID, err)
+		return
+	}
+
+	body := fmt.Sprintf("Please confirm your email address by opening this link within %d hours:\n%s\n\n"+
+		"If you didn't request this, you can ignore this email.",
+		int(emailVerificationTTL.Hours()), appURL("/verify-email?token="+token))
+
+	if err := services.SendMail(email, "Confirm your email address", body); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", userID, err)
+	}
+}
+
+// requireVerifiedEmail rejects the request with 403 until the caller has
+// confirmed their email address.
+func requireVerifiedEmail(db *sql.DB, w http.ResponseWriter, r *http.Request) bool {
+	userID, _ := UserIDFromContext(r.Context())
+
+	var verified bool
+	err := db.QueryRow("SELECT email_verified FROM users WHERE id = $1", userID).Scan(&verified)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("requireVerifiedEmail error:", err)
+		}
+		return false
+	}
+
+	if !verified {
+		http.Error(w, "Please verify your email address first", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func VerifyEmailHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		claims, userID, err := parseToken(req.Token, services.AccessKeys(), emailVerificationTokenType)
+		if err != nil || claims.Email == "" {
+			http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+			return
+		}
+
+		var email, pendingEmail string
+		err = db.QueryRow("SELECT email, COALESCE(pending_email, '') FROM users WHERE id = $1", userID).
+			Scan(&email, &pendingEmail)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("VerifyEmailHandler lookup error:", err)
+			}
+			return
+		}
+
+		switch claims.Email {
+		case pendingEmail:
+			_, err = db.Exec(`
+				UPDATE users
+				SET email = pending_email,
+				    pending_email = NULL,
+				    email_verified = TRUE,
+				    email_verified_at = NOW()
+				WHERE id = $1`, userID)
+		case email:
+			_, err = db.Exec(`
+				UPDATE users
+				SET email_verified = TRUE,
+				    email_verified_at = COALESCE(email_verified_at, NOW())
+				WHERE id = $1`, userID)
+		default:
+			// The address was changed again after this link was sent.
+			http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, "Email is already in use", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+			log.Println("VerifyEmailHandler update error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Email verified successfully",
+			"email":   claims.Email,
+		})
+	}
+}
+
+func ResendVerificationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := UserIDFromContext(r.Context())
+
+		var email, pendingEmail string
+		var verified bool
+		err := db.QueryRow(`
+			SELECT email, COALESCE(pending_email, ''), email_verified
+			FROM users WHERE id = $1`, userID).
+			Scan(&email, &pendingEmail, &verified)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Database query failed", http.StatusInternalServerError)
+				log.Println("ResendVerificationHandler lookup error:", err)
+			}
+			return
+		}
+
+		switch {
+		case pendingEmail != "":
+			go sendVerificationEmail(userID, pendingEmail)
+		case !verified:
+			go sendVerificationEmail(userID, email)
+		default:
+			http.Error(w, "Email is already verified", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+	}
+}
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_refresh_tokens_family_id;
+
+ALTER TABLE refresh_tokens ALTER COLUMN revoked DROP NOT NULL;
+
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS replaced_by;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS family_id;
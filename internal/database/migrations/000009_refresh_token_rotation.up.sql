@@ -0,0 +1,8 @@
+ALTER TABLE refresh_tokens ADD COLUMN family_id UUID NOT NULL DEFAULT gen_random_uuid();
+ALTER TABLE refresh_tokens ADD COLUMN replaced_by INTEGER REFERENCES refresh_tokens(id) ON DELETE SET NULL;
+ALTER TABLE refresh_tokens ADD COLUMN revoked_at TIMESTAMP;
+
+UPDATE refresh_tokens SET revoked = FALSE WHERE revoked IS NULL;
+ALTER TABLE refresh_tokens ALTER COLUMN revoked SET NOT NULL;
+
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
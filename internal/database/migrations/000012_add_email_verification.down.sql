@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS pending_email;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified;
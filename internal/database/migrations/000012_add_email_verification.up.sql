@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN pending_email TEXT;
+
+-- Accounts created before verification existed are trusted as-is.
+UPDATE users SET email_verified = TRUE, email_verified_at = NOW();
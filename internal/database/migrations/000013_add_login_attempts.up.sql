@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    blocked_until TIMESTAMPTZ
+);
+
+CREATE INDEX idx_login_attempts_last_failure_at ON login_attempts(last_failure_at);
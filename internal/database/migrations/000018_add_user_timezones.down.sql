@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_posts_user_id_local_date;
+
+ALTER TABLE posts DROP COLUMN IF EXISTS local_date;
+
+ALTER TABLE users DROP COLUMN IF EXISTS timezone;
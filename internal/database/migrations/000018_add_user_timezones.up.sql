@@ -0,0 +1,19 @@
+ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+
+ALTER TABLE posts ADD COLUMN local_date DATE;
+
+-- Existing posts were limited per UTC day. Should a race have let two through
+-- on the same day, only the first one is dated so the index below can be built.
+UPDATE posts p
+SET local_date = (ranked.created_at AT TIME ZONE 'UTC')::date
+FROM (
+    SELECT id, created_at,
+           ROW_NUMBER() OVER (
+               PARTITION BY user_id, (created_at AT TIME ZONE 'UTC')::date
+               ORDER BY created_at
+           ) AS n
+    FROM posts
+) ranked
+WHERE ranked.id = p.id AND ranked.n = 1;
+
+CREATE UNIQUE INDEX idx_posts_user_id_local_date ON posts(user_id, local_date);
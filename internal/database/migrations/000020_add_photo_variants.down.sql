@@ -0,0 +1,14 @@
+DROP INDEX IF EXISTS idx_uploads_variants_pending;
+
+ALTER TABLE posts
+    DROP COLUMN IF EXISTS blurhash,
+    DROP COLUMN IF EXISTS medium_path,
+    DROP COLUMN IF EXISTS thumbnail_path;
+
+ALTER TABLE uploads
+    DROP COLUMN IF EXISTS variant_claimed_at,
+    DROP COLUMN IF EXISTS variant_attempts,
+    DROP COLUMN IF EXISTS variants_ready,
+    DROP COLUMN IF EXISTS blurhash,
+    DROP COLUMN IF EXISTS medium_key,
+    DROP COLUMN IF EXISTS thumbnail_key;
@@ -0,0 +1,14 @@
+ALTER TABLE uploads
+    ADD COLUMN thumbnail_key TEXT,
+    ADD COLUMN medium_key TEXT,
+    ADD COLUMN blurhash TEXT,
+    ADD COLUMN variants_ready BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN variant_attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN variant_claimed_at TIMESTAMP;
+
+ALTER TABLE posts
+    ADD COLUMN thumbnail_path TEXT,
+    ADD COLUMN medium_path TEXT,
+    ADD COLUMN blurhash TEXT;
+
+CREATE INDEX idx_uploads_variants_pending ON uploads(id) WHERE NOT variants_ready;
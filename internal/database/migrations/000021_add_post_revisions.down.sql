@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_post_revisions_post_id;
+
+DROP TABLE IF EXISTS post_revisions;
+
+ALTER TABLE posts DROP COLUMN IF EXISTS edited_at;
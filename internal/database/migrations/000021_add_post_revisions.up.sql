@@ -0,0 +1,12 @@
+ALTER TABLE posts ADD COLUMN edited_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id SERIAL PRIMARY KEY,
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    template_id INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    photo_path TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_post_revisions_post_id ON post_revisions(post_id);
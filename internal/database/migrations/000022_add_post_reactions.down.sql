@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_post_reactions_user_id;
+
+DROP TABLE IF EXISTS post_reactions;
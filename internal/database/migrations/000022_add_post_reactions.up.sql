@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS post_reactions (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (post_id, user_id)
+);
+
+CREATE INDEX idx_post_reactions_user_id ON post_reactions(user_id);
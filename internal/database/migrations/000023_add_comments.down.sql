@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_comments_parent_id;
+DROP INDEX IF EXISTS idx_comments_post_id;
+
+DROP TABLE IF EXISTS comments;
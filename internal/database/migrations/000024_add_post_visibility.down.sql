@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS default_post_visibility;
+
+ALTER TABLE posts DROP COLUMN IF EXISTS visibility;
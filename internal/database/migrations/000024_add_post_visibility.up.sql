@@ -0,0 +1,7 @@
+ALTER TABLE posts
+    ADD COLUMN visibility TEXT NOT NULL DEFAULT 'buddies'
+    CHECK (visibility IN ('private', 'buddies', 'public'));
+
+ALTER TABLE users
+    ADD COLUMN default_post_visibility TEXT NOT NULL DEFAULT 'buddies'
+    CHECK (default_post_visibility IN ('private', 'buddies', 'public'));
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_buddy_requests_recipient_id;
+DROP INDEX IF EXISTS idx_buddy_requests_pending;
+
+DROP TABLE IF EXISTS buddy_requests;
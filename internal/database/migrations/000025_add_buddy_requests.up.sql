@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS buddy_requests (
+    id SERIAL PRIMARY KEY,
+    requester_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    recipient_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'accepted', 'declined', 'cancelled')),
+    mutual BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    responded_at TIMESTAMP,
+    CHECK (requester_id != recipient_id)
+);
+
+-- At most one open request per direction.
+CREATE UNIQUE INDEX idx_buddy_requests_pending
+    ON buddy_requests(requester_id, recipient_id) WHERE status = 'pending';
+CREATE INDEX idx_buddy_requests_recipient_id ON buddy_requests(recipient_id);
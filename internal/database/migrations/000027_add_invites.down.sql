@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_invite_redemptions_created_at;
+DROP TABLE IF EXISTS invite_redemptions;
+
+DROP INDEX IF EXISTS idx_invites_inviter_id;
+DROP TABLE IF EXISTS invites;
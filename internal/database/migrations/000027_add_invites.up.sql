@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS invites (
+    id SERIAL PRIMARY KEY,
+    inviter_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code TEXT NOT NULL UNIQUE,
+    max_uses INTEGER NOT NULL CHECK (max_uses > 0),
+    use_count INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_invites_inviter_id ON invites(inviter_id);
+
+-- One row per use, kept for growth metrics. new_user marks sign-ups as
+-- opposed to existing users redeeming a code later.
+CREATE TABLE IF NOT EXISTS invite_redemptions (
+    id SERIAL PRIMARY KEY,
+    invite_id INTEGER NOT NULL REFERENCES invites(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    new_user BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (invite_id, user_id)
+);
+
+CREATE INDEX idx_invite_redemptions_created_at ON invite_redemptions(created_at);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_post_circles_circle_id;
+DROP TABLE IF EXISTS post_circles;
+
+DROP INDEX IF EXISTS idx_circle_members_member_id;
+DROP TABLE IF EXISTS circle_members;
+DROP TABLE IF EXISTS circles;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS circles (
+    id SERIAL PRIMARY KEY,
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (owner_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS circle_members (
+    circle_id INTEGER NOT NULL REFERENCES circles(id) ON DELETE CASCADE,
+    member_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (circle_id, member_id)
+);
+
+CREATE INDEX idx_circle_members_member_id ON circle_members(member_id);
+
+-- A buddies-only post with rows here is shown only to members of those
+-- circles; without any it is shown to all buddies.
+CREATE TABLE IF NOT EXISTS post_circles (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    circle_id INTEGER NOT NULL REFERENCES circles(id) ON DELETE CASCADE,
+    PRIMARY KEY (post_id, circle_id)
+);
+
+CREATE INDEX idx_post_circles_circle_id ON post_circles(circle_id);
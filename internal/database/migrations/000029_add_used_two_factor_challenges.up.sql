@@ -0,0 +1,6 @@
+-- Challenge tokens are single-use; their jti is recorded once a login has
+-- been completed with one and kept until the token would have expired.
+CREATE TABLE IF NOT EXISTS used_two_factor_challenges (
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,8 @@
+-- Why a refresh token stopped working: 'rotated' when it was exchanged for a
+-- new one, 'reuse' when its family was killed after a rotated token came
+-- back, and 'signed_out' when the user or an admin ended the session. Only a
+-- rotated token coming back is treated as reuse.
+ALTER TABLE refresh_tokens ADD COLUMN revoked_reason TEXT;
+
+UPDATE refresh_tokens SET revoked_reason = 'rotated' WHERE revoked AND replaced_by IS NOT NULL;
+UPDATE refresh_tokens SET revoked_reason = 'signed_out' WHERE revoked AND revoked_reason IS NULL;
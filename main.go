@@ -3,9 +3,12 @@ package main
 import (
 	"log"
 	"net/http"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/gorilla/mux"
 	"masterboxer.com/project-micro-journal/database"
+	"masterboxer.com/project-micro-journal/handlers"
 	"masterboxer.com/project-micro-journal/routes"
 	"masterboxer.com/project-micro-journal/services"
 )
@@ -17,10 +20,34 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := services.InitSigningKeys(); err != nil {
+		log.Fatal("Failed to load token signing keys:", err)
+	}
+
+	if err := services.InitLoginGuard(db); err != nil {
+		log.Fatal("Failed to set up login throttling:", err)
+	}
+
+	if err := services.InitMailer(); err != nil {
+		log.Fatal("Failed to configure mailer:", err)
+	}
+
+	if err := services.InitOIDC(); err != nil {
+		log.Fatal("Failed to configure OIDC providers:", err)
+	}
+
+	if err := services.InitBlobStore(); err != nil {
+		log.Fatal("Failed to configure blob storage:", err)
+	}
+
 	if err := services.InitFirebase("./project-micro-journal-firebase-adminsdk-fbsvc-e626a40f9b.json"); err != nil {
 		log.Printf("Warning: Firebase initialization failed: %v", err)
 	}
 
+	handlers.StartRefreshTokenCleanup(db, time.Hour)
+	handlers.StartPhotoVariantWorker(db, time.Minute)
+	handlers.StartUploadCleanup(db, time.Hour)
+
 	router := mux.NewRouter()
 
 	routes.CreateUserRoutes(db, router)
@@ -28,6 +55,8 @@ func main() {
 	routes.CreatePostRoutes(db, router)
 	routes.CreateTemplateRoutes(db, router)
 	routes.CreateNotificationRoutes(db, router)
+	routes.CreateSessionRoutes(db, router)
+	routes.CreateModerationRoutes(db, router)
 
 	handler := corsMiddleware(jsonContentTypeMiddleware(router))
 
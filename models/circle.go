@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Circle is a named group of the owner's buddies that posts can be shared
+// with.
+type Circle struct {
+	ID        int           `json:"id"`
+	OwnerID   int           `json:"owner_id"`
+	Name      string        `json:"name"`
+	Members   []UserBuddies `json:"members"`
+	CreatedAt time.Time     `json:"created_at"`
+}
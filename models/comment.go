@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+type Comment struct {
+	ID          int       `json:"id"`
+	PostID      int       `json:"post_id"`
+	UserID      int       `json:"user_id"`
+	ParentID    *int      `json:"parent_id,omitempty"`
+	Text        string    `json:"text"`
+	CreatedAt   time.Time `json:"created_at"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	Replies     []Comment `json:"replies,omitempty"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+type Invite struct {
+	ID        int    `json:"id"`
+	InviterID int    `json:"inviter_id"`
+	Code      string `json:"code"`
+	URL       string `json:"url"`
+	MaxUses   int    `json:"max_uses"`
+	UseCount  int    `json:"use_count"`
+	// SignupCount is how many of the uses created a new account.
+	SignupCount int        `json:"signup_count"`
+	Active      bool       `json:"active"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// InvitePreview is what someone holding a code sees before signing up.
+type InvitePreview struct {
+	Code        string    `json:"code"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type InviterStats struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Redemptions int    `json:"redemptions"`
+	Signups     int    `json:"signups"`
+}
+
+type InviteStats struct {
+	Days          int            `json:"days"`
+	InvitesIssued int            `json:"invites_issued"`
+	Redemptions   int            `json:"redemptions"`
+	Signups       int            `json:"signups"`
+	TopInviters   []InviterStats `json:"top_inviters"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+const (
+	ScopePostsRead     = "posts:read"
+	ScopePostsWrite    = "posts:write"
+	ScopeUsersRead     = "users:read"
+	ScopeBuddiesRead   = "buddies:read"
+	ScopeBuddiesWrite  = "buddies:write"
+	ScopeTemplatesRead = "templates:read"
+)
+
+// PersonalAccessTokenScopes lists every scope a personal access token can be granted.
+var PersonalAccessTokenScopes = []string{
+	ScopePostsRead,
+	ScopePostsWrite,
+	ScopeUsersRead,
+	ScopeBuddiesRead,
+	ScopeBuddiesWrite,
+	ScopeTemplatesRead,
+}
+
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"token,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -2,22 +2,68 @@ package models
 
 import "time"
 
+const (
+	// VisibilityPrivate posts are a journal entry only the author sees.
+	VisibilityPrivate = "private"
+	VisibilityBuddies = "buddies"
+	VisibilityPublic  = "public"
+)
+
 type Post struct {
+	ID         int     `json:"id"`
+	UserID     int     `json:"user_id"`
+	TemplateID int     `json:"template_id"`
+	Text       string  `json:"text"`
+	PhotoPath  *string `json:"photoPath,omitempty"`
+	PhotoURL   string  `json:"photo_url,omitempty"`
+	// Resized copies are generated in the background and stay empty until
+	// they are ready.
+	ThumbnailPath string     `json:"thumbnail_path,omitempty"`
+	ThumbnailURL  string     `json:"thumbnail_url,omitempty"`
+	MediumPath    string     `json:"medium_path,omitempty"`
+	MediumURL     string     `json:"medium_url,omitempty"`
+	Blurhash      string     `json:"blurhash,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Edited        bool       `json:"edited"`
+	EditedAt      *time.Time `json:"edited_at,omitempty"`
+	Visibility    string     `json:"visibility"`
+	// CircleIDs limits a buddies-only post to members of these circles.
+	// It is only shown to the author.
+	CircleIDs []int `json:"circle_ids,omitempty"`
+}
+
+type PostWithUser struct {
+	ID            int     `json:"id"`
+	UserID        int     `json:"user_id"`
+	TemplateID    int     `json:"template_id"`
+	Text          string  `json:"text"`
+	PhotoPath     string  `json:"photo_path"`
+	PhotoURL      string  `json:"photo_url,omitempty"`
+	ThumbnailPath string  `json:"thumbnail_path,omitempty"`
+	ThumbnailURL  string  `json:"thumbnail_url,omitempty"`
+	MediumPath    string  `json:"medium_path,omitempty"`
+	MediumURL     string  `json:"medium_url,omitempty"`
+	Blurhash      string  `json:"blurhash,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+	Edited        bool    `json:"edited"`
+	EditedAt      *string `json:"edited_at,omitempty"`
+	Visibility    string  `json:"visibility"`
+	Username      string  `json:"username"`
+	DisplayName   string  `json:"display_name"`
+	// Reactions counts each emoji used on the post; MyReaction is the
+	// viewer's own, if any.
+	Reactions    map[string]int `json:"reactions"`
+	MyReaction   string         `json:"my_reaction,omitempty"`
+	CommentCount int            `json:"comment_count"`
+}
+
+// PostRevision is an earlier version of a post, saved when it is edited.
+type PostRevision struct {
 	ID         int       `json:"id"`
-	UserID     int       `json:"user_id"`
+	PostID     int       `json:"post_id"`
 	TemplateID int       `json:"template_id"`
 	Text       string    `json:"text"`
-	PhotoPath  *string   `json:"photoPath,omitempty"`
+	PhotoPath  string    `json:"photo_path,omitempty"`
+	PhotoURL   string    `json:"photo_url,omitempty"`
 	CreatedAt  time.Time `json:"created_at"`
 }
-
-type PostWithUser struct {
-	ID          int    `json:"id"`
-	UserID      int    `json:"user_id"`
-	TemplateID  int    `json:"template_id"`
-	Text        string `json:"text"`
-	PhotoPath   string `json:"photo_path"`
-	CreatedAt   string `json:"created_at"`
-	Username    string `json:"username"`
-	DisplayName string `json:"display_name"`
-}
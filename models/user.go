@@ -7,17 +7,31 @@ import (
 )
 
 type User struct {
-	ID          int       `json:"id"`
-	Username    string    `json:"username"`
-	DisplayName string    `json:"display_name"`
-	DOB         CivilDate `json:"dob"`
-	Gender      string    `json:"gender"`
-	Email       string    `json:"email"`
-	Password    string    `json:"password,omitempty"`
-	FCMToken    string    `json:"fcm_token,omitempty"`
-	CreatedAt   string    `json:"created_at"`
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	DisplayName   string    `json:"display_name"`
+	DOB           CivilDate `json:"dob"`
+	Gender        string    `json:"gender"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	PendingEmail  string    `json:"pending_email,omitempty"`
+	Role          string    `json:"role,omitempty"`
+	Timezone      string    `json:"timezone,omitempty"`
+	// DefaultPostVisibility is used for new posts that do not set one.
+	DefaultPostVisibility string `json:"default_post_visibility,omitempty"`
+	Password              string `json:"password,omitempty"`
+	FCMToken              string `json:"fcm_token,omitempty"`
+	// InviteCode is only read on sign-up.
+	InviteCode string `json:"invite_code,omitempty"`
+	CreatedAt  string `json:"created_at"`
 }
 
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type Buddy struct {
 	ID        int    `json:"id"`
 	UserID    int    `json:"user_id"`
@@ -88,3 +102,34 @@ type UserSearchResult struct {
 	Email       string    `json:"email"`
 	CreatedAt   string    `json:"created_at"`
 }
+
+const (
+	BuddyRequestPending   = "pending"
+	BuddyRequestAccepted  = "accepted"
+	BuddyRequestDeclined  = "declined"
+	BuddyRequestCancelled = "cancelled"
+)
+
+// BuddyRequest asks RecipientID to let RequesterID see their posts. When
+// Mutual is set, accepting also lets the recipient see the requester's.
+// Username and DisplayName describe the other party from the caller's view.
+type BuddyRequest struct {
+	ID          int        `json:"id"`
+	RequesterID int        `json:"requester_id"`
+	RecipientID int        `json:"recipient_id"`
+	Status      string     `json:"status"`
+	Mutual      bool       `json:"mutual"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+	Username    string     `json:"username,omitempty"`
+	DisplayName string     `json:"display_name,omitempty"`
+}
+
+// BuddySuggestion is someone the user's buddies are buddies with.
+type BuddySuggestion struct {
+	ID            int      `json:"id"`
+	Username      string   `json:"username"`
+	DisplayName   string   `json:"display_name"`
+	MutualCount   int      `json:"mutual_count"`
+	MutualBuddies []string `json:"mutual_buddies"`
+}
@@ -10,9 +10,48 @@ import (
 func CreateAuthenticationRoutes(db *sql.DB, router *mux.Router) *mux.Router {
 
 	router.HandleFunc("/login", handlers.LoginHandler(db)).Methods("POST")
+	router.HandleFunc("/login/2fa", handlers.VerifyTwoFactorLogin(db)).Methods("POST")
+	router.HandleFunc("/login/oidc/providers", handlers.GetOIDCProviders()).Methods("GET")
+	router.HandleFunc("/login/oidc/signup", handlers.OIDCSignupHandler(db)).Methods("POST")
+	router.HandleFunc("/login/oidc/{provider}", handlers.OIDCLoginHandler(db)).Methods("POST")
 	router.HandleFunc("/logout", handlers.LogoutHandler(db)).Methods("POST")
 	router.HandleFunc("/verify-token", handlers.VerifyTokenHandler(db)).Methods("POST")
 	router.HandleFunc("/refresh-token", handlers.RefreshTokenHandler(db)).Methods("POST")
+	router.HandleFunc("/password/forgot", handlers.ForgotPasswordHandler(db)).Methods("POST")
+	router.HandleFunc("/password/reset", handlers.ResetPasswordHandler(db)).Methods("POST")
+	router.HandleFunc("/email/verify", handlers.VerifyEmailHandler(db)).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler()).Methods("GET")
+
+	protected := protectedRouter(db, router)
+
+	protected.HandleFunc("/email/resend-verification", handlers.ResendVerificationHandler(db)).Methods("POST")
+
+	protected.HandleFunc("/2fa/enroll", handlers.EnrollTwoFactor(db)).Methods("POST")
+	protected.HandleFunc("/2fa/confirm", handlers.ConfirmTwoFactor(db)).Methods("POST")
+	protected.HandleFunc("/2fa/disable", handlers.DisableTwoFactor(db)).Methods("POST")
+	protected.HandleFunc("/2fa/recovery-codes", handlers.RegenerateRecoveryCodes(db)).Methods("POST")
 
 	return router
 }
+
+// protectedRouter returns a subrouter whose routes require a valid access token.
+func protectedRouter(db *sql.DB, router *mux.Router) *mux.Router {
+	protected := router.NewRoute().Subrouter()
+	protected.Use(handlers.AuthMiddleware(db))
+	return protected
+}
+
+// scopedRouter is like protectedRouter but also accepts personal access
+// tokens granted scope.
+func scopedRouter(db *sql.DB, router *mux.Router, scope string) *mux.Router {
+	scoped := router.NewRoute().Subrouter()
+	scoped.Use(handlers.ScopedAuthMiddleware(db, scope))
+	return scoped
+}
+
+// roleRouter returns a subrouter limited to authenticated callers with one of roles.
+func roleRouter(db *sql.DB, router *mux.Router, roles ...string) *mux.Router {
+	restricted := protectedRouter(db, router).NewRoute().Subrouter()
+	restricted.Use(handlers.RequireRole(roles...))
+	return restricted
+}
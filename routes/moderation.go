@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"database/sql"
+
+	"github.com/gorilla/mux"
+	"masterboxer.com/project-micro-journal/handlers"
+	"masterboxer.com/project-micro-journal/models"
+)
+
+func CreateModerationRoutes(db *sql.DB, router *mux.Router) *mux.Router {
+	moderators := roleRouter(db, router, models.RoleModerator, models.RoleAdmin)
+	admins := roleRouter(db, router, models.RoleAdmin)
+
+	moderators.HandleFunc("/moderation/posts/{id}", handlers.ModerateDeletePost(db)).Methods("DELETE")
+	admins.HandleFunc("/admin/users/{id}/role", handlers.SetUserRole(db)).Methods("PUT")
+
+	return router
+}
@@ -8,8 +8,9 @@ import (
 )
 
 func CreateNotificationRoutes(db *sql.DB, router *mux.Router) *mux.Router {
+	protected := protectedRouter(db, router)
 
-	router.HandleFunc("/fcm/register-token", handlers.RegisterFCMToken(db)).Methods("POST")
+	protected.HandleFunc("/fcm/register-token", handlers.RegisterFCMToken(db)).Methods("POST")
 
 	return router
 }
@@ -5,14 +5,31 @@ import (
 
 	"github.com/gorilla/mux"
 	"masterboxer.com/project-micro-journal/handlers"
+	"masterboxer.com/project-micro-journal/models"
 )
 
 func CreatePostRoutes(db *sql.DB, router *mux.Router) *mux.Router {
-	router.HandleFunc("/posts/today", handlers.GetTodayPostForUser(db)).Methods("GET")
-	router.HandleFunc("/posts", handlers.CreatePost(db)).Methods("POST")
-	router.HandleFunc("/posts/user/{userId}", handlers.GetPostsByUser(db)).Methods("GET")
-	router.HandleFunc("/posts/{id}", handlers.DeletePost(db)).Methods("DELETE")
-	router.HandleFunc("/posts/{userId}/feed", handlers.GetBuddyPosts(db)).Methods("GET")
+	postsRead := scopedRouter(db, router, models.ScopePostsRead)
+	postsWrite := scopedRouter(db, router, models.ScopePostsWrite)
+
+	postsRead.HandleFunc("/posts/today", handlers.GetTodayPostForUser(db)).Methods("GET")
+	postsWrite.HandleFunc("/posts", handlers.CreatePost(db)).Methods("POST")
+	postsRead.HandleFunc("/posts/user/{userId}", handlers.GetPostsByUser(db)).Methods("GET")
+	postsWrite.HandleFunc("/posts/{id}", handlers.UpdatePost(db)).Methods("PUT")
+	postsWrite.HandleFunc("/posts/{id}", handlers.DeletePost(db)).Methods("DELETE")
+	postsRead.HandleFunc("/posts/{id}/revisions", handlers.GetPostRevisions(db)).Methods("GET")
+	postsRead.HandleFunc("/posts/{userId}/feed", handlers.GetBuddyPosts(db)).Methods("GET")
+
+	postsRead.HandleFunc("/reactions", handlers.GetReactionEmojis()).Methods("GET")
+	postsWrite.HandleFunc("/posts/{id}/reactions", handlers.SetReaction(db)).Methods("PUT")
+	postsWrite.HandleFunc("/posts/{id}/reactions", handlers.DeleteReaction(db)).Methods("DELETE")
+
+	postsRead.HandleFunc("/posts/{id}/comments", handlers.GetComments(db)).Methods("GET")
+	postsWrite.HandleFunc("/posts/{id}/comments", handlers.CreateComment(db)).Methods("POST")
+	postsWrite.HandleFunc("/posts/{id}/comments/{commentId}", handlers.DeleteComment(db)).Methods("DELETE")
+
+	postsWrite.HandleFunc("/uploads", handlers.UploadPhoto(db)).Methods("POST")
+	router.HandleFunc("/media/{key:.+}", handlers.ServeMedia()).Methods("GET")
 
 	return router
 }
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"database/sql"
+
+	"github.com/gorilla/mux"
+	"masterboxer.com/project-micro-journal/handlers"
+)
+
+func CreateSessionRoutes(db *sql.DB, router *mux.Router) *mux.Router {
+	protected := protectedRouter(db, router)
+
+	protected.HandleFunc("/sessions", handlers.GetSessions(db)).Methods("GET")
+	protected.HandleFunc("/sessions/{id}", handlers.RevokeSession(db)).Methods("DELETE")
+	protected.HandleFunc("/logout-all", handlers.LogoutAllHandler(db)).Methods("POST")
+
+	protected.HandleFunc("/tokens", handlers.GetPersonalAccessTokens(db)).Methods("GET")
+	protected.HandleFunc("/tokens", handlers.CreatePersonalAccessToken(db)).Methods("POST")
+	protected.HandleFunc("/tokens/{id}", handlers.RevokePersonalAccessToken(db)).Methods("DELETE")
+
+	return router
+}
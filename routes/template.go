@@ -5,15 +5,18 @@ import (
 
 	"github.com/gorilla/mux"
 	"masterboxer.com/project-micro-journal/handlers"
+	"masterboxer.com/project-micro-journal/models"
 )
 
 func CreateTemplateRoutes(db *sql.DB, router *mux.Router) *mux.Router {
+	templatesRead := scopedRouter(db, router, models.ScopeTemplatesRead)
+	admins := roleRouter(db, router, models.RoleAdmin)
 
-	router.HandleFunc("/templates", handlers.GetTemplates(db)).Methods("GET")
-	router.HandleFunc("/templates/{id}", handlers.GetTemplateByID(db)).Methods("GET")
-	router.HandleFunc("/templates", handlers.CreateTemplate(db)).Methods("POST")
-	router.HandleFunc("/templates/{id}", handlers.UpdateTemplate(db)).Methods("PUT")
-	router.HandleFunc("/templates/{id}", handlers.DeleteTemplate(db)).Methods("DELETE")
+	templatesRead.HandleFunc("/templates", handlers.GetTemplates(db)).Methods("GET")
+	templatesRead.HandleFunc("/templates/{id}", handlers.GetTemplateByID(db)).Methods("GET")
+	admins.HandleFunc("/templates", handlers.CreateTemplate(db)).Methods("POST")
+	admins.HandleFunc("/templates/{id}", handlers.UpdateTemplate(db)).Methods("PUT")
+	admins.HandleFunc("/templates/{id}", handlers.DeleteTemplate(db)).Methods("DELETE")
 
 	return router
 }
@@ -5,21 +5,60 @@ import (
 
 	"github.com/gorilla/mux"
 	"masterboxer.com/project-micro-journal/handlers"
+	"masterboxer.com/project-micro-journal/models"
 )
 
 func CreateUserRoutes(db *sql.DB, router *mux.Router) *mux.Router {
 
-	router.HandleFunc("/users/search", handlers.SearchUsers(db)).Methods("GET")
-	router.HandleFunc("/users", handlers.GetUsers(db)).Methods("GET")
-	router.HandleFunc("/users/{id}", handlers.GetUserById(db)).Methods("GET")
-	router.HandleFunc("/users/{id}", handlers.UpdateUser(db)).Methods("PUT")
-	router.HandleFunc("/users/{id}", handlers.DeleteUser(db)).Methods("DELETE")
 	router.HandleFunc("/users", handlers.CreateUser(db)).Methods("POST")
+	router.HandleFunc("/invites/{code}", handlers.GetInvitePreview(db)).Methods("GET")
+
+	protected := protectedRouter(db, router)
+	usersRead := scopedRouter(db, router, models.ScopeUsersRead)
+	buddiesRead := scopedRouter(db, router, models.ScopeBuddiesRead)
+	buddiesWrite := scopedRouter(db, router, models.ScopeBuddiesWrite)
+	admins := roleRouter(db, router, models.RoleAdmin)
+
+	admins.HandleFunc("/users", handlers.GetUsers(db)).Methods("GET")
+	admins.HandleFunc("/admin/invites/stats", handlers.GetInviteStats(db)).Methods("GET")
+
+	usersRead.HandleFunc("/users/search", handlers.SearchUsers(db)).Methods("GET")
+	usersRead.HandleFunc("/users/{id}", handlers.GetUserById(db)).Methods("GET")
+	protected.HandleFunc("/users/{id}", handlers.UpdateUser(db)).Methods("PUT")
+	protected.HandleFunc("/users/{id}", handlers.DeleteUser(db)).Methods("DELETE")
+	protected.HandleFunc("/users/{id}/password", handlers.ChangePasswordHandler(db)).Methods("PUT")
 
 	// Buddy routes
-	router.HandleFunc("/users/{user_id}/buddies", handlers.GetUserBuddies(db)).Methods("GET")
-	router.HandleFunc("/users/{user_id}/buddies", handlers.AddBuddyWithNotification(db)).Methods("POST")
-	router.HandleFunc("/users/{user_id}/buddies/{buddy_id}", handlers.RemoveBuddy(db)).Methods("DELETE")
+	buddiesRead.HandleFunc("/users/{user_id}/buddies", handlers.GetUserBuddies(db)).Methods("GET")
+	buddiesWrite.HandleFunc("/users/{user_id}/buddies", handlers.CreateBuddyRequest(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/buddies/{buddy_id}", handlers.RemoveBuddy(db)).Methods("DELETE")
+	buddiesRead.HandleFunc("/users/{user_id}/buddy-suggestions", handlers.GetBuddySuggestions(db)).Methods("GET")
+
+	buddiesRead.HandleFunc("/users/{user_id}/buddy-requests/incoming", handlers.GetIncomingBuddyRequests(db)).Methods("GET")
+	buddiesRead.HandleFunc("/users/{user_id}/buddy-requests/outgoing", handlers.GetOutgoingBuddyRequests(db)).Methods("GET")
+	buddiesWrite.HandleFunc("/users/{user_id}/buddy-requests", handlers.CreateBuddyRequest(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/buddy-requests/{request_id}/accept", handlers.AcceptBuddyRequest(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/buddy-requests/{request_id}/decline", handlers.DeclineBuddyRequest(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/buddy-requests/{request_id}/cancel", handlers.CancelBuddyRequest(db)).Methods("POST")
+
+	buddiesRead.HandleFunc("/users/{user_id}/blocks", handlers.GetBlockedUsers(db)).Methods("GET")
+	buddiesWrite.HandleFunc("/users/{user_id}/blocks", handlers.BlockUser(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/blocks/{target_id}", handlers.UnblockUser(db)).Methods("DELETE")
+	buddiesRead.HandleFunc("/users/{user_id}/mutes", handlers.GetMutedUsers(db)).Methods("GET")
+	buddiesWrite.HandleFunc("/users/{user_id}/mutes", handlers.MuteUser(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/mutes/{target_id}", handlers.UnmuteUser(db)).Methods("DELETE")
+
+	buddiesRead.HandleFunc("/users/{user_id}/circles", handlers.GetCircles(db)).Methods("GET")
+	buddiesWrite.HandleFunc("/users/{user_id}/circles", handlers.CreateCircle(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/circles/{circle_id}", handlers.RenameCircle(db)).Methods("PUT")
+	buddiesWrite.HandleFunc("/users/{user_id}/circles/{circle_id}", handlers.DeleteCircle(db)).Methods("DELETE")
+	buddiesWrite.HandleFunc("/users/{user_id}/circles/{circle_id}/members", handlers.AddCircleMember(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/circles/{circle_id}/members/{member_id}", handlers.RemoveCircleMember(db)).Methods("DELETE")
+
+	buddiesRead.HandleFunc("/users/{user_id}/invites", handlers.GetInvites(db)).Methods("GET")
+	buddiesWrite.HandleFunc("/users/{user_id}/invites", handlers.CreateInvite(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/invites/redeem", handlers.RedeemInvite(db)).Methods("POST")
+	buddiesWrite.HandleFunc("/users/{user_id}/invites/{invite_id}", handlers.RevokeInvite(db)).Methods("DELETE")
 
 	return router
 }
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps uploaded files. Keys are slash separated relative paths
+// such as "photos/12/3f2a.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// URL returns a link that lets anyone holding it read key until ttl passes.
+	URL(key string, ttl time.Duration) (string, error)
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// validBlobKey rejects keys that could escape the store's root.
+func validBlobKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	return path.Clean("/"+key) == "/"+key
+}
+
+// LocalBlobStore keeps blobs on disk under Dir. Reads go through the server
+// at BaseURL with an HMAC signed, expiring query string.
+type LocalBlobStore struct {
+	Dir     string
+	BaseURL string
+	secret  []byte
+}
+
+func NewLocalBlobStore(dir, baseURL string, secret []byte) *LocalBlobStore {
+	return &LocalBlobStore{Dir: dir, BaseURL: strings.TrimRight(baseURL, "/"), secret: secret}
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+// Open returns the file for key so it can be served with http.ServeContent.
+func (s *LocalBlobStore) Open(key string) (*os.File, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalBlobStore) URL(key string, ttl time.Duration) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", s.signature(key, expires))
+	return s.BaseURL + "/" + key + "?" + q.Encode(), nil
+}
+
+// VerifyURL checks the expires and sig query parameters produced by URL.
+func (s *LocalBlobStore) VerifyURL(key, expiresParam, sig string) bool {
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.signature(key, expires)))
+}
+
+var blobStore BlobStore
+
+// InitBlobStore picks the upload backend from BLOB_STORE: "local" (default)
+// or "s3".
+//
+// The local store writes under MEDIA_DIR (default ./uploads) and serves files
+// from MEDIA_BASE_URL, signing links with MEDIA_URL_SECRET. The S3 store is
+// configured by the S3_* variables described in NewS3BlobStoreFromEnv.
+func InitBlobStore() error {
+	switch backend := os.Getenv("BLOB_STORE"); backend {
+	case "", "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "./uploads"
+		}
+		baseURL := os.Getenv("MEDIA_BASE_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:8200/media"
+		}
+
+		secret := []byte(os.Getenv("MEDIA_URL_SECRET"))
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return err
+			}
+			log.Println("Warning: MEDIA_URL_SECRET is not set, photo links will stop working on restart")
+		}
+
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating MEDIA_DIR: %w", err)
+		}
+		blobStore = NewLocalBlobStore(dir, baseURL, secret)
+	case "s3":
+		store, err := NewS3BlobStoreFromEnv()
+		if err != nil {
+			return err
+		}
+		blobStore = store
+	default:
+		return fmt.Errorf("unknown BLOB_STORE %q", backend)
+	}
+	return nil
+}
+
+func Blobs() BlobStore {
+	return blobStore
+}
@@ -0,0 +1,375 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// maxImagePixels guards against decompression bombs: small files that
+// decode into enormous bitmaps.
+const maxImagePixels = 40_000_000
+
+var ErrUnsupportedImage = errors.New("unsupported image type")
+
+// ProcessedImage is an upload after SanitizeImage.
+type ProcessedImage struct {
+	Data        []byte
+	ContentType string
+	Extension   string
+	Width       int
+	Height      int
+}
+
+// SanitizeImage decodes a JPEG or PNG and encodes it again from the pixels
+// alone. That drops EXIF (including GPS position), XMP and any other
+// metadata. The EXIF orientation is applied first so photos taken sideways
+// still display upright.
+func SanitizeImage(data []byte) (*ProcessedImage, error) {
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, ErrUnsupportedImage
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errors.New("image dimensions are too large")
+	}
+
+	var out bytes.Buffer
+	var img image.Image
+	if contentType == "image/jpeg" {
+		img, err = jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		img = applyOrientation(img, jpegOrientation(data))
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+	} else {
+		img, err = png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		err = png.Encode(&out, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	processed := &ProcessedImage{
+		Data:        out.Bytes(),
+		ContentType: contentType,
+		Extension:   ".png",
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}
+	if contentType == "image/jpeg" {
+		processed.Extension = ".jpg"
+	}
+	return processed, nil
+}
+
+// jpegOrientation reads the EXIF orientation tag (1-8) from a JPEG, or
+// returns 1 when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// Start of scan: the metadata segments are all behind us.
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation returns img transformed so that it displays upright for
+// the given EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// DecodeImage decodes a stored JPEG or PNG.
+func DecodeImage(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// EncodeJPEG encodes img at the given quality (1-100).
+func EncodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// flatten copies img onto an opaque white canvas, so transparent PNGs do not
+// turn black when encoded as JPEG.
+func flatten(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// ResizeToFit scales img down so that neither side exceeds maxSize, averaging
+// every source pixel that falls into each destination pixel. Images that
+// already fit are only flattened.
+func ResizeToFit(img image.Image, maxSize int) *image.RGBA {
+	src := flatten(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxSize && h <= maxSize {
+		return src
+	}
+
+	dw, dh := maxSize, maxSize
+	if w > h {
+		dh = int(math.Max(1, math.Round(float64(h)*float64(maxSize)/float64(w))))
+	} else {
+		dw = int(math.Max(1, math.Round(float64(w)*float64(maxSize)/float64(h))))
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*h/dh, (y+1)*h/dh
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*w/dw, (x+1)*w/dw
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, n int
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					i += 4
+					n++
+				}
+			}
+
+			di := dst.PixOffset(x, y)
+			dst.Pix[di] = uint8(r / n)
+			dst.Pix[di+1] = uint8(g / n)
+			dst.Pix[di+2] = uint8(b / n)
+			dst.Pix[di+3] = 0xFF
+		}
+	}
+	return dst
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash encodes img as a BlurHash (https://blurha.sh) with the given
+// number of horizontal and vertical components (1-9). Clients render it as a
+// placeholder while the photo loads. Pass a small image; the cost grows with
+// the pixel count.
+func Blurhash(img image.Image, xComponents, yComponents int) string {
+	src := flatten(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := src.PixOffset(x, y)
+			linear[y*w+x] = [3]float64{
+				sRGBToLinear(src.Pix[i]),
+				sRGBToLinear(src.Pix[i+1]),
+				sRGBToLinear(src.Pix[i+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+
+			scale := normalisation / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	ac := factors[1:]
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		out[i-1] = base83Chars[digit]
+	}
+	return string(out)
+}
+
+func sRGBToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
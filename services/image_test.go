@@ -0,0 +1,242 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// exifSegment builds an APP1 segment holding a single orientation tag.
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	entry := tiff[10:]
+	order.PutUint16(entry, 0x0112)
+	order.PutUint16(entry[2:], 3)
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], orientation)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// withSegment inserts segment right after a JPEG's start of image marker.
+func withSegment(jpg, segment []byte) []byte {
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+// twoPixelJPEG is 2x1: red on the left, blue on the right.
+func twoPixelJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{0, 0, 255, 255})
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := twoPixelJPEG(t)
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", plain, 1},
+		{"big endian", withSegment(plain, exifSegment(binary.BigEndian, 6)), 6},
+		{"little endian", withSegment(plain, exifSegment(binary.LittleEndian, 8)), 8},
+		{"out of range", withSegment(plain, exifSegment(binary.BigEndian, 9)), 1},
+		{"truncated", withSegment(plain, exifSegment(binary.BigEndian, 6))[:20], 1},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: jpegOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeImageAppliesOrientationAndDropsExif(t *testing.T) {
+	data := withSegment(twoPixelJPEG(t), exifSegment(binary.BigEndian, 6))
+
+	out, err := SanitizeImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.ContentType != "image/jpeg" || out.Extension != ".jpg" {
+		t.Errorf("got %s %s, want image/jpeg .jpg", out.ContentType, out.Extension)
+	}
+	// Orientation 6 means the camera was turned a quarter clockwise.
+	if out.Width != 1 || out.Height != 2 {
+		t.Fatalf("got %dx%d, want 1x2", out.Width, out.Height)
+	}
+	if bytes.Contains(out.Data, []byte("Exif")) {
+		t.Error("EXIF data survived sanitizing")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(out.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, _, _, _ := img.At(0, 0).RGBA()
+	bottom, _, _, _ := img.At(0, 1).RGBA()
+	if top <= bottom {
+		t.Errorf("the red pixel should now be on top (red %d over %d)", top>>8, bottom>>8)
+	}
+}
+
+func TestSanitizeImagePNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := SanitizeImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.ContentType != "image/png" || out.Extension != ".png" || out.Width != 3 || out.Height != 2 {
+		t.Errorf("got %+v", out)
+	}
+}
+
+func TestSanitizeImageRejectsOtherTypes(t *testing.T) {
+	for _, data := range [][]byte{[]byte("GIF89a"), []byte("<svg></svg>"), nil} {
+		if _, err := SanitizeImage(data); err != ErrUnsupportedImage {
+			t.Errorf("SanitizeImage(%q) error = %v, want ErrUnsupportedImage", data, err)
+		}
+	}
+}
+
+func TestSanitizeImageRejectsDecompressionBombs(t *testing.T) {
+	// Only the header is needed: the dimensions are checked before decoding.
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 10000)
+	binary.BigEndian.PutUint32(ihdr[4:], 10000)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 2 // truecolor
+
+	chunk := append([]byte("IHDR"), ihdr...)
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)))
+	data = append(data, chunk...)
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(chunk))
+
+	_, err := SanitizeImage(data)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("got error %v, want image dimensions are too large", err)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.RGBA{0, 0, 255, 255})
+	red := color.RGBA{255, 0, 0, 255}
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		redAt       image.Point
+	}{
+		{1, 2, 1, image.Pt(0, 0)},
+		{2, 2, 1, image.Pt(1, 0)},
+		{3, 2, 1, image.Pt(1, 0)},
+		{6, 1, 2, image.Pt(0, 0)},
+		{8, 1, 2, image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		if b := got.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if c := color.RGBAModel.Convert(got.At(tt.redAt.X, tt.redAt.Y)); c != red {
+			t.Errorf("orientation %d: pixel %v is %v, want red", tt.orientation, tt.redAt, c)
+		}
+	}
+}
+
+func TestBlurhashOfSolidImage(t *testing.T) {
+	white := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			white.Set(x, y, color.White)
+		}
+	}
+
+	// With a single component the hash is the size flag, a zero AC
+	// maximum and the average colour: white is 0xFFFFFF, "TSUA" in base 83.
+	if got, want := Blurhash(white, 1, 1), "00TSUA"; got != want {
+		t.Errorf("Blurhash 1x1 = %s, want %s", got, want)
+	}
+
+	// 4x3 components is size flag "L"; the DC term is unchanged.
+	got := Blurhash(white, 4, 3)
+	if len(got) != 6+2*11 || got[0] != 'L' || got[2:6] != "TSUA" {
+		t.Errorf("Blurhash 4x3 = %s, want L?TSUA followed by 11 AC components", got)
+	}
+}
+
+func TestBlurhashEncodesStructure(t *testing.T) {
+	gradient := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	mirrored := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			v := uint8(x * 16)
+			gradient.Set(x, y, color.RGBA{v, v, v, 255})
+			mirrored.Set(15-x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+
+	a := Blurhash(gradient, 4, 3)
+	b := Blurhash(mirrored, 4, 3)
+	if len(a) != 6+2*11 {
+		t.Errorf("hash %q has length %d, want %d", a, len(a), 6+2*11)
+	}
+	if a == b {
+		t.Error("a gradient and its mirror image have the same hash")
+	}
+	if a[2:6] != b[2:6] {
+		t.Errorf("mirroring changed the average colour: %s vs %s", a[2:6], b[2:6])
+	}
+}
+
+func TestEncodeBase83(t *testing.T) {
+	tests := []struct {
+		value, length int
+		want          string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		{16777215, 4, "TSUA"},
+	}
+	for _, tt := range tests {
+		if got := encodeBase83(tt.value, tt.length); got != tt.want {
+			t.Errorf("encodeBase83(%d, %d) = %q, want %q", tt.value, tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptStore keeps failed login counters. Counters older than the window
+// passed to RecordFailure start over.
+type AttemptStore interface {
+	Get(key string) (failures int, blockedUntil time.Time, err error)
+	RecordFailure(key string, window time.Duration) (failures int, err error)
+	Block(key string, until time.Time) error
+	Reset(key string) error
+	Prune(before time.Time) error
+}
+
+// AttemptPolicy turns a failure count into a wait. The first FreeAttempts
+// failures cost nothing, each one after that doubles the delay up to
+// MaxDelay, and reaching LockoutThreshold locks the key for LockoutDuration.
+type AttemptPolicy struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	Window           time.Duration
+}
+
+func (p AttemptPolicy) blockFor(failures int) time.Duration {
+	if failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+	if failures < p.FreeAttempts {
+		return 0
+	}
+
+	shift := failures - p.FreeAttempts
+	if shift > 30 {
+		return p.MaxDelay
+	}
+	delay := p.BaseDelay << shift
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// LoginGuard throttles password attempts per email and per client IP.
+type LoginGuard struct {
+	store       AttemptStore
+	emailPolicy AttemptPolicy
+	ipPolicy    AttemptPolicy
+}
+
+func NewLoginGuard(store AttemptStore, emailPolicy, ipPolicy AttemptPolicy) *LoginGuard {
+	return &LoginGuard{store: store, emailPolicy: emailPolicy, ipPolicy: ipPolicy}
+}
+
+func emailAttemptKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// RetryAfter reports how long the caller has to wait before trying again.
+func (g *LoginGuard) RetryAfter(email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{emailAttemptKey(email), ipAttemptKey(ip)} {
+		_, blockedUntil, err := g.store.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if d := time.Until(blockedUntil); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// RecordFailure counts a failed attempt and returns the resulting wait.
+func (g *LoginGuard) RecordFailure(email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	checks := []struct {
+		key    string
+		policy AttemptPolicy
+	}{
+		{emailAttemptKey(email), g.emailPolicy},
+		{ipAttemptKey(ip), g.ipPolicy},
+	}
+
+	for _, c := range checks {
+		failures, err := g.store.RecordFailure(c.key, c.policy.Window)
+		if err != nil {
+			return 0, err
+		}
+
+		block := c.policy.blockFor(failures)
+		if block <= 0 {
+			continue
+		}
+		if err := g.store.Block(c.key, time.Now().Add(block)); err != nil {
+			return 0, err
+		}
+		if block > wait {
+			wait = block
+		}
+	}
+	return wait, nil
+}
+
+// RecordSuccess clears the email counter. The IP counter is left alone so a
+// single valid account cannot be used to reset a password spraying run.
+func (g *LoginGuard) RecordSuccess(email string) error {
+	return g.store.Reset(emailAttemptKey(email))
+}
+
+// MemoryAttemptStore keeps counters in process. It is only correct when a
+// single replica is serving logins.
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	entries map[string]*attemptEntry
+}
+
+type attemptEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{entries: make(map[string]*attemptEntry)}
+}
+
+func (s *MemoryAttemptStore) Get(key string) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return 0, time.Time{}, nil
+	}
+	return e.failures, e.blockedUntil, nil
+}
+
+func (s *MemoryAttemptStore) RecordFailure(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &attemptEntry{}
+		s.entries[key] = e
+	}
+	if now.Sub(e.lastFailure) > window {
+		e.failures = 0
+	}
+	e.failures++
+	e.lastFailure = now
+	return e.failures, nil
+}
+
+func (s *MemoryAttemptStore) Block(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		e.blockedUntil = until
+	}
+	return nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryAttemptStore) Prune(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.entries {
+		if e.lastFailure.Before(before) && e.blockedUntil.Before(time.Now()) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// PostgresAttemptStore shares counters between replicas through the
+// login_attempts table.
+type PostgresAttemptStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAttemptStore(db *sql.DB) *PostgresAttemptStore {
+	return &PostgresAttemptStore{db: db}
+}
+
+func (s *PostgresAttemptStore) Get(key string) (int, time.Time, error) {
+	var failures int
+	var blockedUntil sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT failures, blocked_until
+		FROM login_attempts
+		WHERE key = $1`, key).Scan(&failures, &blockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failures, blockedUntil.Time, nil
+}
+
+func (s *PostgresAttemptStore) RecordFailure(key string, window time.Duration) (int, error) {
+	var failures int
+	err := s.db.QueryRow(`
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failure_at < NOW() - $2 * INTERVAL '1 second' THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures`,
+		key, int64(window.Seconds())).Scan(&failures)
+	return failures, err
+}
+
+func (s *PostgresAttemptStore) Block(key string, until time.Time) error {
+	_, err := s.db.Exec(`UPDATE login_attempts SET blocked_until = $1 WHERE key = $2`, until, key)
+	return err
+}
+
+func (s *PostgresAttemptStore) Reset(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
+
+func (s *PostgresAttemptStore) Prune(before time.Time) error {
+	_, err := s.db.Exec(`
+		DELETE FROM login_attempts
+		WHERE last_failure_at < $1
+		  AND (blocked_until IS NULL OR blocked_until < NOW())`, before)
+	return err
+}
+
+var loginGuard *LoginGuard
+
+// InitLoginGuard sets up login throttling. LOGIN_ATTEMPT_STORE picks the
+// backend ("postgres" by default, or "memory"), LOGIN_MAX_FAILURES the number
+// of failures per email before a lockout and LOGIN_LOCKOUT_MINUTES its length.
+func InitLoginGuard(db *sql.DB) error {
+	maxFailures := 10
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES")); err == nil && n > 0 {
+		maxFailures = n
+	}
+	lockout := 15 * time.Minute
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_MINUTES")); err == nil && n > 0 {
+		lockout = time.Duration(n) * time.Minute
+	}
+
+	emailPolicy := AttemptPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: maxFailures,
+		LockoutDuration:  lockout,
+		Window:           time.Hour,
+	}
+	// Many people can share one address behind a NAT, so IPs get more room.
+	ipPolicy := AttemptPolicy{
+		FreeAttempts:     20,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: maxFailures * 10,
+		LockoutDuration:  time.Hour,
+		Window:           time.Hour,
+	}
+
+	var store AttemptStore
+	switch backend := os.Getenv("LOGIN_ATTEMPT_STORE"); backend {
+	case "", "postgres":
+		store = NewPostgresAttemptStore(db)
+	case "memory":
+		store = NewMemoryAttemptStore()
+	default:
+		return fmt.Errorf("unknown LOGIN_ATTEMPT_STORE %q", backend)
+	}
+
+	loginGuard = NewLoginGuard(store, emailPolicy, ipPolicy)
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := store.Prune(time.Now().Add(-time.Hour)); err != nil {
+				log.Printf("Error pruning login attempts: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func GetLoginGuard() *LoginGuard {
+	return loginGuard
+}
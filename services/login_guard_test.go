@@ -0,0 +1,159 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+var testPolicy = AttemptPolicy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         8 * time.Second,
+	LockoutThreshold: 10,
+	LockoutDuration:  time.Hour,
+	Window:           time.Hour,
+}
+
+func TestAttemptPolicyBlockFor(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{9, 8 * time.Second},
+		{10, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.blockFor(tt.failures); got != tt.want {
+			t.Errorf("blockFor(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	// Large counts must not overflow the shift into a short or negative delay.
+	huge := testPolicy
+	huge.LockoutThreshold = 1000
+	if got := huge.blockFor(500); got != huge.MaxDelay {
+		t.Errorf("blockFor(500) = %v, want %v", got, huge.MaxDelay)
+	}
+}
+
+func TestLoginGuardThrottlesByEmail(t *testing.T) {
+	g := NewLoginGuard(NewMemoryAttemptStore(), testPolicy, AttemptPolicy{
+		FreeAttempts:     100,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	})
+
+	for i := 0; i < 2; i++ {
+		if wait, err := g.RecordFailure("Ada@Example.com", "10.0.0.1"); err != nil || wait != 0 {
+			t.Fatalf("failure %d: wait %v, err %v", i+1, wait, err)
+		}
+	}
+	if wait, _ := g.RecordFailure("ada@example.com ", "10.0.0.2"); wait != time.Second {
+		t.Fatalf("third failure waited %v, want 1s", wait)
+	}
+
+	wait, err := g.RetryAfter("ADA@example.com", "10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("RetryAfter = %v, want up to 1s", wait)
+	}
+	if wait, _ := g.RetryAfter("grace@example.com", "10.0.0.3"); wait != 0 {
+		t.Errorf("another email has to wait %v", wait)
+	}
+}
+
+func TestLoginGuardThrottlesByIP(t *testing.T) {
+	g := NewLoginGuard(NewMemoryAttemptStore(), AttemptPolicy{
+		FreeAttempts:     100,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	}, testPolicy)
+
+	// Spraying different accounts from one address still adds up.
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		g.RecordFailure(email, "10.0.0.1")
+	}
+	if wait, _ := g.RecordFailure("c@example.com", "10.0.0.1"); wait != time.Second {
+		t.Fatalf("third failure from one IP waited %v, want 1s", wait)
+	}
+	if wait, _ := g.RetryAfter("d@example.com", "10.0.0.1"); wait <= 0 {
+		t.Error("blocked IP was not throttled for a new email")
+	}
+	if wait, _ := g.RetryAfter("d@example.com", "10.0.0.2"); wait != 0 {
+		t.Errorf("another IP has to wait %v", wait)
+	}
+}
+
+func TestLoginGuardRecordSuccessKeepsIPCounter(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	g := NewLoginGuard(store, testPolicy, testPolicy)
+
+	for i := 0; i < 3; i++ {
+		g.RecordFailure("ada@example.com", "10.0.0.1")
+	}
+	if err := g.RecordSuccess("ADA@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if failures, _, _ := store.Get(emailAttemptKey("ada@example.com")); failures != 0 {
+		t.Errorf("email counter is %d after a success, want 0", failures)
+	}
+	if failures, _, _ := store.Get(ipAttemptKey("10.0.0.1")); failures != 3 {
+		t.Errorf("IP counter is %d after a success, want 3", failures)
+	}
+}
+
+func TestMemoryAttemptStoreWindow(t *testing.T) {
+	s := NewMemoryAttemptStore()
+
+	for i := 1; i <= 3; i++ {
+		if n, _ := s.RecordFailure("k", time.Hour); n != i {
+			t.Fatalf("failure %d counted as %d", i, n)
+		}
+	}
+
+	// Counters start over once the last failure is older than the window.
+	s.entries["k"].lastFailure = time.Now().Add(-2 * time.Hour)
+	if n, _ := s.RecordFailure("k", time.Hour); n != 1 {
+		t.Errorf("failure after the window counted as %d, want 1", n)
+	}
+}
+
+func TestMemoryAttemptStoreBlockAndPrune(t *testing.T) {
+	s := NewMemoryAttemptStore()
+
+	// Blocking an unknown key is a no-op rather than creating an entry.
+	s.Block("unknown", time.Now().Add(time.Hour))
+	if _, until, _ := s.Get("unknown"); !until.IsZero() {
+		t.Errorf("unknown key is blocked until %v", until)
+	}
+
+	s.RecordFailure("stale", time.Hour)
+	s.RecordFailure("blocked", time.Hour)
+	s.RecordFailure("fresh", time.Hour)
+	s.entries["stale"].lastFailure = time.Now().Add(-2 * time.Hour)
+	s.entries["blocked"].lastFailure = time.Now().Add(-2 * time.Hour)
+	s.Block("blocked", time.Now().Add(time.Hour))
+
+	if err := s.Prune(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.entries["stale"]; ok {
+		t.Error("stale entry was not pruned")
+	}
+	if _, ok := s.entries["blocked"]; !ok {
+		t.Error("entry that is still blocked was pruned")
+	}
+	if _, ok := s.entries["fresh"]; !ok {
+		t.Error("recent entry was pruned")
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers plain-text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends mail through an SMTP relay using PLAIN auth when a
+// username is configured.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// FileMailer appends every message to a file, or to the log when Path is
+// empty. It is meant for local development and tests. Messages written to
+// the log have their link tokens redacted, since the log is also where a
+// deploy that forgot MAIL_DRIVER ends up sending them.
+type FileMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	entry := fmt.Sprintf("Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), to, subject, body)
+
+	if m.Path == "" {
+		log.Printf("Mail not sent (log mailer):\n%s", redactTokens(entry))
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(entry)
+	return err
+}
+
+var linkTokenPattern = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+// redactTokens hides the secret in any "token=" query parameter in s.
+func redactTokens(s string) string {
+	return linkTokenPattern.ReplaceAllString(s, "${1}[redacted]")
+}
+
+var mailer Mailer = &FileMailer{}
+
+// InitMailer picks the mailer from MAIL_DRIVER: "smtp" uses the SMTP_*
+// settings, "file" writes to MAIL_FILE_PATH, anything else logs messages
+// with their link tokens redacted.
+func InitMailer() error {
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		if m.Host == "" || m.From == "" {
+			return fmt.Errorf("SMTP_HOST and MAIL_FROM must be set for the smtp mail driver")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		mailer = m
+	case "file":
+		mailer = &FileMailer{Path: os.Getenv("MAIL_FILE_PATH")}
+	default:
+		mailer = &FileMailer{}
+	}
+	return nil
+}
+
+// SetMailer replaces the mailer, e.g. with a FileMailer in tests.
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+func SendMail(to, subject, body string) error {
+	return mailer.Send(to, subject, body)
+}
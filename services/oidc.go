@@ -0,0 +1,378 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// OIDCProvider verifies ID tokens from one OpenID Connect issuer. Endpoints
+// and signing keys are discovered from the issuer on first use, so the
+// provider can be any spec-compliant server, including a local mock.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientIDs    []string
+	ClientSecret string
+	HTTPClient   *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCClaims are the ID token claims used to find or create an account.
+type OIDCClaims struct {
+	Email           string       `json:"email"`
+	EmailVerified   flexibleBool `json:"email_verified"`
+	Name            string       `json:"name"`
+	PreferredName   string       `json:"preferred_username"`
+	Nonce           string       `json:"nonce"`
+	AuthorizedParty string       `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// flexibleBool accepts both true and "true"; some providers, Apple among them,
+// send email_verified as a string.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// keyRefreshInterval limits how often an unknown kid can trigger a JWKS fetch.
+const keyRefreshInterval = time.Minute
+
+var (
+	oidcProviders     map[string]*OIDCProvider
+	oidcProviderNames []string
+)
+
+// InitOIDC reads the providers listed in OIDC_PROVIDERS (comma separated, for
+// example "google,apple"). Each one needs OIDC_<NAME>_ISSUER and
+// OIDC_<NAME>_CLIENT_ID; the client ID may be a comma separated list when the
+// web and mobile apps are registered separately. OIDC_<NAME>_CLIENT_SECRET is
+// only needed to redeem authorization codes.
+func InitOIDC() error {
+	oidcProviders = make(map[string]*OIDCProvider)
+	oidcProviderNames = nil
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		issuer := strings.TrimRight(os.Getenv(prefix+"ISSUER"), "/")
+		if issuer == "" {
+			return fmt.Errorf("%sISSUER is not set", prefix)
+		}
+
+		var clientIDs []string
+		for _, id := range strings.Split(os.Getenv(prefix+"CLIENT_ID"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				clientIDs = append(clientIDs, id)
+			}
+		}
+		if len(clientIDs) == 0 {
+			return fmt.Errorf("%sCLIENT_ID is not set", prefix)
+		}
+
+		oidcProviders[name] = &OIDCProvider{
+			Name:         name,
+			Issuer:       issuer,
+			ClientIDs:    clientIDs,
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+		}
+		oidcProviderNames = append(oidcProviderNames, name)
+	}
+	return nil
+}
+
+func GetOIDCProvider(name string) (*OIDCProvider, bool) {
+	p, ok := oidcProviders[name]
+	return p, ok
+}
+
+func OIDCProviderNames() []string {
+	return oidcProviderNames
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, expected %q", d.Issuer, p.Issuer)
+	}
+	if d.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// AuthorizationEndpoint is where clients send the user to sign in.
+func (p *OIDCProvider) AuthorizationEndpoint(ctx context.Context) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return d.AuthorizationEndpoint, nil
+}
+
+// signingKey returns the key for kid, refetching the JWKS when the provider
+// has rotated to a key we have not seen yet.
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (interface{}, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	var set JWKS
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysFetchedAt = time.Now()
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+func (k JWK) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// VerifyIDToken checks the signature, issuer, audience and expiry of an ID
+// token. When nonce is not empty it must match the token's nonce claim.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*OIDCClaims, error) {
+	claims := &OIDCClaims{}
+	token, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "EdDSA"}))
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	if strings.TrimRight(claims.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if claims.Subject == "" || claims.ExpiresAt == nil {
+		return nil, errors.New("missing required claims")
+	}
+
+	audienceOK := false
+	for _, id := range p.ClientIDs {
+		if claims.VerifyAudience(id, true) {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("ID token was not issued for this app")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != "" {
+		authorized := false
+		for _, id := range p.ClientIDs {
+			if claims.AuthorizedParty == id {
+				authorized = true
+				break
+			}
+		}
+		if !authorized {
+			return nil, fmt.Errorf("unexpected authorized party %q", claims.AuthorizedParty)
+		}
+	}
+
+	if nonce != "" && claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns
+// the ID token from the response. codeVerifier is the PKCE verifier the
+// client generated, if any.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, redirectURI, codeVerifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	if d.TokenEndpoint == "" {
+		return "", errors.New("discovery document has no token_endpoint")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.ClientIDs[0])
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const mockClientID = "journal-app"
+
+// mockOIDCServer is a minimal OpenID provider: discovery, a JWKS endpoint
+// whose keys can be rotated, and a token endpoint that trades one code for
+// an ID token.
+type mockOIDCServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	keys          map[string]*ecdsa.PrivateKey
+	jwksHits      int
+	code          string
+	idToken       string
+	lastTokenForm map[string]string
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	t.Helper()
+	m := &mockOIDCServer{keys: map[string]*ecdsa.PrivateKey{}}
+	m.addKey(t, "key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.jwksHits++
+
+		set := JWKS{Keys: []JWK{}}
+		for kid, key := range m.keys {
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "EC",
+				KeyID:     kid,
+				Use:       "sig",
+				Algorithm: "ES256",
+				Curve:     "P-256",
+				X:         base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				Y:         base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.lastTokenForm = map[string]string{}
+		for k := range r.PostForm {
+			m.lastTokenForm[k] = r.PostForm.Get(k)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != m.code {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":             "invalid_grant",
+				"error_description": "unknown code",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken, "token_type": "Bearer"})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOIDCServer) addKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.keys[kid] = key
+	m.mu.Unlock()
+}
+
+func (m *mockOIDCServer) sign(t *testing.T, kid string, claims jwt.Claims) string {
+	t.Helper()
+	m.mu.Lock()
+	key := m.keys[kid]
+	m.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// claims returns valid ID token claims that individual tests then break.
+func (m *mockOIDCServer) claims() *OIDCClaims {
+	now := time.Now()
+	return &OIDCClaims{
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		Nonce:         "nonce-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.URL,
+			Subject:   "user-123",
+			Audience:  jwt.ClaimStrings{mockClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+}
+
+func (m *mockOIDCServer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:         "mock",
+		Issuer:       m.URL,
+		ClientIDs:    []string{mockClientID},
+		ClientSecret: "secret",
+		HTTPClient:   m.Client(),
+	}
+}
+
+func TestVerifyIDTokenAcceptsValidToken(t *testing.T) {
+	m := newMockOIDCServer(t)
+	p := m.provider()
+
+	claims, err := p.VerifyIDToken(context.Background(), m.sign(t, "key-1", m.claims()), "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if claims.Subject != "user-123" || claims.Email != "ada@example.com" || !bool(claims.EmailVerified) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestVerifyIDTokenRejectsBadClaims(t *testing.T) {
+	m := newMockOIDCServer(t)
+
+	tests := []struct {
+		name   string
+		modify func(c *OIDCClaims)
+		nonce  string
+		want   string
+	}{
+		{
+			name:   "wrong issuer",
+			modify: func(c *OIDCClaims) { c.Issuer = "https://evil.example.com" },
+			want:   "unexpected issuer",
+		},
+		{
+			name:   "wrong audience",
+			modify: func(c *OIDCClaims) { c.Audience = jwt.ClaimStrings{"someone-else"} },
+			want:   "not issued for this app",
+		},
+		{
+			name: "foreign authorized party",
+			modify: func(c *OIDCClaims) {
+				c.Audience = jwt.ClaimStrings{mockClientID, "someone-else"}
+				c.AuthorizedParty = "someone-else"
+			},
+			want: "unexpected authorized party",
+		},
+		{
+			name:   "nonce mismatch",
+			modify: func(c *OIDCClaims) { c.Nonce = "nonce-2" },
+			nonce:  "nonce-1",
+			want:   "nonce mismatch",
+		},
+		{
+			name: "expired",
+			modify: func(c *OIDCClaims) {
+				c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Hour))
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			},
+			want: "invalid ID token",
+		},
+		{
+			name:   "missing subject",
+			modify: func(c *OIDCClaims) { c.Subject = "" },
+			want:   "missing required claims",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := m.claims()
+			tt.modify(claims)
+
+			_, err := m.provider().VerifyIDToken(context.Background(), m.sign(t, "key-1", claims), tt.nonce)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAllowsListedAuthorizedParty(t *testing.T) {
+	m := newMockOIDCServer(t)
+	p := m.provider()
+	p.ClientIDs = []string{mockClientID, "journal-ios"}
+
+	claims := m.claims()
+	claims.Audience = jwt.ClaimStrings{mockClientID, "journal-ios"}
+	claims.AuthorizedParty = "journal-ios"
+
+	if _, err := p.VerifyIDToken(context.Background(), m.sign(t, "key-1", claims), ""); err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsUnsignedAndForgedTokens(t *testing.T) {
+	m := newMockOIDCServer(t)
+	p := m.provider()
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, m.claims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), unsigned, ""); err == nil {
+		t.Error("unsigned token was accepted")
+	}
+
+	forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, m.claims())
+	token.Header["kid"] = "key-1"
+	forged, err := token.SignedString(forger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), forged, ""); err == nil {
+		t.Error("token signed with the wrong key was accepted")
+	}
+}
+
+func TestVerifyIDTokenRefetchesKeysForUnknownKid(t *testing.T) {
+	m := newMockOIDCServer(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, m.sign(t, "key-1", m.claims()), ""); err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+
+	// The provider rotates to a key we have not seen. Right after a fetch the
+	// JWKS is not fetched again, so a flood of bogus kids cannot hammer it.
+	m.addKey(t, "key-2")
+	rotated := m.sign(t, "key-2", m.claims())
+	if _, err := p.VerifyIDToken(ctx, rotated, ""); err == nil || !strings.Contains(err.Error(), "unknown kid") {
+		t.Fatalf("got error %v, want unknown kid", err)
+	}
+	if m.jwksHits != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", m.jwksHits)
+	}
+
+	p.keysFetchedAt = time.Now().Add(-keyRefreshInterval)
+	if _, err := p.VerifyIDToken(ctx, rotated, ""); err != nil {
+		t.Fatalf("VerifyIDToken after rotation: %v", err)
+	}
+	if m.jwksHits != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", m.jwksHits)
+	}
+}
+
+func TestDiscoveryRejectsMismatchedIssuer(t *testing.T) {
+	m := newMockOIDCServer(t)
+	p := m.provider()
+	p.Issuer = m.URL + "/other"
+
+	if _, err := p.AuthorizationEndpoint(context.Background()); err == nil {
+		t.Fatal("discovery for another issuer was accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	m := newMockOIDCServer(t)
+	p := m.provider()
+	m.code = "code-1"
+	m.idToken = m.sign(t, "key-1", m.claims())
+
+	idToken, err := p.Exchange(context.Background(), "code-1", "app://callback", "verifier-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if idToken != m.idToken {
+		t.Errorf("got ID token %q, want %q", idToken, m.idToken)
+	}
+
+	want := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          "code-1",
+		"redirect_uri":  "app://callback",
+		"client_id":     mockClientID,
+		"client_secret": "secret",
+		"code_verifier": "verifier-1",
+	}
+	for k, v := range want {
+		if got := m.lastTokenForm[k]; got != v {
+			t.Errorf("token request %s = %q, want %q", k, got, v)
+		}
+	}
+
+	if _, err := p.VerifyIDToken(context.Background(), idToken, "nonce-1"); err != nil {
+		t.Errorf("exchanged ID token did not verify: %v", err)
+	}
+}
+
+func TestExchangeReportsTokenEndpointErrors(t *testing.T) {
+	m := newMockOIDCServer(t)
+	m.code = "code-1"
+
+	_, err := m.provider().Exchange(context.Background(), "wrong-code", "app://callback", "")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("got error %v, want invalid_grant", err)
+	}
+}
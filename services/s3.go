@@ -0,0 +1,281 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3BlobStore talks to S3 or any S3-compatible service (MinIO, R2, ...)
+// using Signature Version 4.
+type S3BlobStore struct {
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key. Most self-hosted services need it.
+	PathStyle  bool
+	HTTPClient *http.Client
+}
+
+// unsignedPayload skips hashing the body; the connection is expected to be
+// TLS protected.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// NewS3BlobStoreFromEnv reads S3_ENDPOINT (default https://s3.amazonaws.com),
+// S3_REGION (default us-east-1), S3_BUCKET, S3_ACCESS_KEY_ID,
+// S3_SECRET_ACCESS_KEY and S3_PATH_STYLE.
+func NewS3BlobStoreFromEnv() (*S3BlobStore, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	store := &S3BlobStore{
+		Endpoint:        u,
+		Region:          region,
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+		HTTPClient:      &http.Client{Timeout: 30 * time.Second},
+	}
+	if store.Bucket == "" || store.AccessKeyID == "" || store.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+	}
+	return store, nil
+}
+
+func (s *S3BlobStore) objectURL(key string) *url.URL {
+	u := *s.Endpoint
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+	return &u
+}
+
+func (s *S3BlobStore) do(ctx context.Context, method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+
+	u := s.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": unsignedPayload,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if contentType != "" {
+		headers["content-type"] = contentType
+	}
+
+	signedHeaders, signature := s.sign(method, u, url.Values{}, headers, now)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, s.scope(now), signedHeaders, signature))
+
+	return s.HTTPClient.Do(req)
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, body, size, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 PUT %s: %s %s", key, resp.Status, msg)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrBlobNotFound
+	default:
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("S3 GET %s: %s %s", key, resp.Status, msg)
+	}
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 DELETE %s: %s %s", key, resp.Status, msg)
+	}
+	return nil
+}
+
+// URL returns a presigned GET link. S3 caps presigned links at seven days.
+func (s *S3BlobStore) URL(key string, ttl time.Duration) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return s.presign(key, time.Now().UTC(), ttl), nil
+}
+
+func (s *S3BlobStore) presign(key string, now time.Time, ttl time.Duration) string {
+	u := s.objectURL(key)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	_, signature := s.sign(http.MethodGet, u, query, map[string]string{"host": u.Host}, now)
+	query.Set("X-Amz-Signature", signature)
+
+	u.RawQuery = canonicalQuery(query)
+	return u.String()
+}
+
+func (s *S3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// sign computes a SigV4 signature over the request and returns it along with
+// the list of signed headers.
+func (s *S3BlobStore) sign(method string, u *url.URL, query url.Values, headers map[string]string, now time.Time) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := headers["x-amz-content-sha256"]
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		awsURIEscape(u.Path, false),
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsURIEscape(k, true)+"="+awsURIEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEscape percent-encodes everything except unreserved characters, as
+// SigV4 requires. Slashes are kept in paths and encoded in query values.
+func awsURIEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
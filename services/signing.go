@@ -0,0 +1,290 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SigningKey is one entry of a KeySet. Keys without private material can only
+// verify, which is how retired asymmetric keys are kept around until every
+// token they signed has expired.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet signs with its current key and verifies with any key it holds,
+// selected by the kid header.
+type KeySet struct {
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+type keyConfig struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKey     string `json:"private_key,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKey      string `json:"public_key,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+type keySetConfig struct {
+	Current string      `json:"current"`
+	Keys    []keyConfig `json:"keys"`
+}
+
+var (
+	accessKeys  *KeySet
+	refreshKeys *KeySet
+)
+
+// InitSigningKeys loads the access and refresh token key sets. Each one is read
+// from JWT_<KIND>_KEYS_FILE, then JWT_<KIND>_KEYS (both JSON), and finally
+// falls back to a single HS256 key from JWT_<KIND>_SECRET.
+func InitSigningKeys() error {
+	var err error
+	if accessKeys, err = loadKeySet("ACCESS"); err != nil {
+		return fmt.Errorf("loading access token keys: %w", err)
+	}
+	if refreshKeys, err = loadKeySet("REFRESH"); err != nil {
+		return fmt.Errorf("loading refresh token keys: %w", err)
+	}
+	return nil
+}
+
+func AccessKeys() *KeySet {
+	return accessKeys
+}
+
+func RefreshKeys() *KeySet {
+	return refreshKeys
+}
+
+func loadKeySet(kind string) (*KeySet, error) {
+	var raw []byte
+	if path := os.Getenv("JWT_" + kind + "_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		raw = data
+	} else if value := os.Getenv("JWT_" + kind + "_KEYS"); value != "" {
+		raw = []byte(value)
+	}
+
+	var cfg keySetConfig
+	if raw != nil {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid key set JSON: %w", err)
+		}
+	} else {
+		secret := os.Getenv("JWT_" + kind + "_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("none of JWT_%[1]s_KEYS_FILE, JWT_%[1]s_KEYS or JWT_%[1]s_SECRET is set", kind)
+		}
+		cfg = keySetConfig{
+			Current: "default",
+			Keys:    []keyConfig{{ID: "default", Algorithm: "HS256", Secret: secret}},
+		}
+	}
+
+	return newKeySet(cfg.Current, cfg.Keys)
+}
+
+// newKeySet builds a KeySet from key definitions; currentID names the key used
+// for signing.
+func newKeySet(currentID string, configs []keyConfig) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*SigningKey)}
+
+	for _, c := range configs {
+		if c.ID == "" {
+			return nil, fmt.Errorf("key is missing a kid")
+		}
+		if _, exists := ks.keys[c.ID]; exists {
+			return nil, fmt.Errorf("duplicate kid %q", c.ID)
+		}
+
+		key, err := parseKeyConfig(c)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", c.ID, err)
+		}
+		ks.keys[c.ID] = key
+	}
+
+	current, ok := ks.keys[currentID]
+	if !ok {
+		return nil, fmt.Errorf("current key %q is not defined", currentID)
+	}
+	if current.signKey == nil {
+		return nil, fmt.Errorf("current key %q has no private key", currentID)
+	}
+	ks.current = current
+
+	return ks, nil
+}
+
+func parseKeyConfig(c keyConfig) (*SigningKey, error) {
+	key := &SigningKey{ID: c.ID}
+
+	privatePEM, err := pemValue(c.PrivateKey, c.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := pemValue(c.PublicKey, c.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Algorithm {
+	case "HS256":
+		if len(c.Secret) < 32 {
+			return nil, fmt.Errorf("HS256 secret must be at least 32 bytes")
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.signKey = []byte(c.Secret)
+		key.verifyKey = []byte(c.Secret)
+
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if privatePEM != nil {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		} else if publicPEM != nil {
+			public, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	case "EdDSA":
+		key.Method = jwt.SigningMethodEdDSA
+		if privatePEM != nil {
+			private, err := jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = private.(ed25519.PrivateKey).Public()
+		} else if publicPEM != nil {
+			public, err := jwt.ParseEdPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", c.Algorithm)
+	}
+
+	if key.verifyKey == nil {
+		return nil, fmt.Errorf("no key material provided")
+	}
+	return key, nil
+}
+
+func pemValue(inline, path string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
+
+// Sign signs claims with the current key and stamps its kid in the header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.current.Method, claims)
+	token.Header["kid"] = ks.current.ID
+	return token.SignedString(ks.current.signKey)
+}
+
+// Keyfunc resolves the verification key from the kid header, refusing tokens
+// whose alg does not match the key's algorithm.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+// Methods lists the algorithms of every key in the set.
+func (ks *KeySet) Methods() []string {
+	seen := make(map[string]bool)
+	var methods []string
+	for _, key := range ks.keys {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the public half of every asymmetric key. Shared secrets are
+// never included.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: key.Method.Alg(),
+				N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: key.Method.Alg(),
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return jwks
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 appendix B,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTPMatchesRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes; authenticator apps show the last 6.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step, ok := ValidateTOTP(rfc6238Secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("code %s at %d was rejected", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / totpPeriod; step != want {
+			t.Errorf("code %s at %d matched step %d, want %d", tt.code, tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTOTPAllowsOneStepOfDrift(t *testing.T) {
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	for _, offset := range []int64{-1, 0, 1} {
+		code := totpCode(key, current+offset)
+		step, ok := ValidateTOTP(rfc6238Secret, code, now)
+		if !ok || step != current+offset {
+			t.Errorf("offset %d: got step %d, ok %v", offset, step, ok)
+		}
+	}
+	for _, offset := range []int64{-2, 2} {
+		if _, ok := ValidateTOTP(rfc6238Secret, totpCode(key, current+offset), now); ok {
+			t.Errorf("code %d steps away was accepted", offset)
+		}
+	}
+}
+
+func TestValidateTOTPNormalizesInput(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	if _, ok := ValidateTOTP(" "+strings.ToLower(rfc6238Secret)+" ", " 287 082 ", now); !ok {
+		t.Error("lower case secret and spaced code were rejected")
+	}
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("code %q was accepted", code)
+		}
+	}
+	if _, ok := ValidateTOTP("not base32!", "287082", now); ok {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	a, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("two secrets were identical")
+	}
+	key, err := totpEncoding.DecodeString(a)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes (%v), want 20", a, len(key), err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("Micro Journal", "ada@example.com", rfc6238Secret)
+
+	want := "otpauth://totp/Micro%20Journal:ada@example.com?"
+	if !strings.HasPrefix(uri, want) {
+		t.Fatalf("got %q, want prefix %q", uri, want)
+	}
+	for _, param := range []string{"secret=" + rfc6238Secret, "issuer=Micro+Journal", "digits=6", "period=30", "algorithm=SHA1"} {
+		if !strings.Contains(uri, param) {
+			t.Errorf("%q is missing %s", uri, param)
+		}
+	}
+}